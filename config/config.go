@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,13 +22,299 @@ type Config struct {
 	HealthCheck         bool        `yaml:"tcp_health_check"`
 	HealthCheckInterval uint        `yaml:"health_check_interval"`
 	MaxAllowed          uint        `yaml:"max_allowed"`
+	AdaptiveLimit       *Limit      `yaml:"adaptive_limit"`
+	AccessLog           *AccessLog  `yaml:"access_log"`
+	Tracing             *Tracing    `yaml:"tracing"`
+	TrustedProxies      []string    `yaml:"trusted_proxies"`
+	AcceptProxyProtocol bool        `yaml:"accept_proxy_protocol"`
+	Listeners           []*Listener `yaml:"listeners"`
+	PoolStatusPattern   string      `yaml:"pool_status_pattern"`
+	MirrorStatusPattern string      `yaml:"mirror_status_pattern"`
+	CachePurgePattern   string      `yaml:"cache_purge_pattern"`
+	H2C                 bool        `yaml:"h2c"`
+	Redirect            *Redirect   `yaml:"redirect_https"`
+	HSTS                *HSTS       `yaml:"hsts"`
+	// Certificates are selected by SNI, ssl_certificate is the default one
+	Certificates              []*Certificate `yaml:"certificates"`
+	CertificateReloadInterval uint           `yaml:"certificate_reload_interval"`
+	TLS                       *TLS           `yaml:"tls"`
+	// the timeouts of the servers are in seconds, 0 refers to no timeout
+	ReadHeaderTimeout uint   `yaml:"read_header_timeout"`
+	ReadTimeout       uint   `yaml:"read_timeout"`
+	WriteTimeout      uint   `yaml:"write_timeout"`
+	IdleTimeout       uint   `yaml:"idle_timeout"`
+	MaxHeaderBytes    int    `yaml:"max_header_bytes"`
+	ClientMaxBodySize uint64 `yaml:"client_max_body_size"`
 }
 
-// Location routing details of balancer
+// TLS policy details of a https listener
+type TLS struct {
+	MinVersion       string   `yaml:"min_version"`
+	MaxVersion       string   `yaml:"max_version"`
+	CipherSuites     []string `yaml:"cipher_suites"`
+	CurvePreferences []string `yaml:"curve_preferences"`
+	ALPN             []string `yaml:"alpn"`
+	// ClientAuth refers to the client certificate policy, none, request or require
+	ClientAuth          string `yaml:"client_auth"`
+	ClientCA            string `yaml:"client_ca"`
+	ClientSubjectHeader string `yaml:"client_subject_header"`
+}
+
+// Certificate a certificate and its private key
+type Certificate struct {
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
+}
+
+// Listener details of a server started by the balancer,
+// it serves the locations listed by name, or all of them if none is listed.
+// A tcp or udp listener proxies the connections to a single location.
+type Listener struct {
+	Name                string    `yaml:"name"`
+	Address             string    `yaml:"address"`
+	Schema              string    `yaml:"schema"`
+	SSLCertificate      string    `yaml:"ssl_certificate"`
+	SSLCertificateKey   string    `yaml:"ssl_certificate_key"`
+	AcceptProxyProtocol bool      `yaml:"accept_proxy_protocol"`
+	Locations           []string  `yaml:"locations"`
+	Redirect            *Redirect `yaml:"redirect_https"`
+	HSTS                *HSTS     `yaml:"hsts"`
+	// H2C serves http/2 without tls, with prior knowledge, on a http listener
+	H2C bool `yaml:"h2c"`
+	// Certificates are selected by SNI, ssl_certificate is the default one
+	Certificates              []*Certificate `yaml:"certificates"`
+	CertificateReloadInterval uint           `yaml:"certificate_reload_interval"`
+	TLS                       *TLS           `yaml:"tls"`
+}
+
+// Redirect http to https redirect details of a listener, at the top level
+// it starts a companion http listener on `address` for the https schema
+type Redirect struct {
+	Enabled    bool     `yaml:"enabled"`
+	Address    string   `yaml:"address"`
+	Port       int      `yaml:"port"`
+	Status     int      `yaml:"status"`
+	Exceptions []string `yaml:"exceptions"`
+}
+
+// HSTS Strict-Transport-Security details of a listener
+type HSTS struct {
+	Enabled           bool `yaml:"enabled"`
+	MaxAge            uint `yaml:"max_age"`
+	IncludeSubdomains bool `yaml:"include_subdomains"`
+	Preload           bool `yaml:"preload"`
+}
+
+// Tracing OpenTelemetry tracing details of balancer
+type Tracing struct {
+	Enabled     bool    `yaml:"enabled"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// AccessLog access log details of balancer
+type AccessLog struct {
+	Enabled    bool   `yaml:"enabled"`
+	Format     string `yaml:"format"`
+	Path       string `yaml:"path"`
+	MaxSize    uint   `yaml:"max_size"`
+	MaxBackups uint   `yaml:"max_backups"`
+}
+
+// Limit adaptive concurrency limit details of balancer
+type Limit struct {
+	Enabled       bool   `yaml:"enabled"`
+	Algorithm     string `yaml:"algorithm"`
+	InitialLimit  uint   `yaml:"initial_limit"`
+	MinLimit      uint   `yaml:"min_limit"`
+	MaxLimit      uint   `yaml:"max_limit"`
+	Timeout       uint   `yaml:"timeout"`
+	StatusPattern string `yaml:"status_pattern"`
+}
+
+// Location routing details of balancer, it is referred to by its name,
+// which is the pattern unless it is set
 type Location struct {
+	Name        string   `yaml:"name"`
 	Pattern     string   `yaml:"pattern"`
 	ProxyPass   []string `yaml:"proxy_pass"`
 	BalanceMode string   `yaml:"balance_mode"`
+	// PathMatch refers to the matching of the pattern, exact, prefix or regex,
+	// the pattern is a gorilla mux path template if empty
+	PathMatch string            `yaml:"path_match"`
+	Hosts     []string          `yaml:"hosts"`
+	Methods   []string          `yaml:"methods"`
+	Headers   map[string]string `yaml:"headers"`
+	Query     map[string]string `yaml:"query"`
+	// Priority orders the matching of the locations, the highest first
+	Priority int `yaml:"priority"`
+	// SendProxyProtocol refers to the PROXY protocol version sent to the backends, v1 or v2
+	SendProxyProtocol string       `yaml:"send_proxy_protocol"`
+	UpstreamTLS       *UpstreamTLS `yaml:"upstream_tls"`
+	Transport         *Transport   `yaml:"transport"`
+	Upgrade           *Upgrade     `yaml:"upgrade"`
+	TCP               *TCP         `yaml:"tcp"`
+	UDP               *UDP         `yaml:"udp"`
+	Rewrite           *Rewrite     `yaml:"rewrite"`
+	Mirror            *Mirror      `yaml:"mirror"`
+	Cache             *Cache       `yaml:"cache"`
+	Compression       *Compression `yaml:"compression"`
+	ErrorPages        *ErrorPages  `yaml:"error_pages"`
+	// Groups split the traffic of the location, they replace proxy_pass
+	Groups     []*Group     `yaml:"groups"`
+	SplitRules []*SplitRule `yaml:"split_rules"`
+	// RequestHeaders and ResponseHeaders are modified for the backends and the clients
+	RequestHeaders     *HeaderRules `yaml:"request_headers"`
+	ResponseHeaders    *HeaderRules `yaml:"response_headers"`
+	HideBackendHeaders bool         `yaml:"hide_backend_headers"`
+	// GRPC talks http/2 to the backends, h2c to http backends
+	GRPC              bool   `yaml:"grpc"`
+	GRPCHealthCheck   bool   `yaml:"grpc_health_check"`
+	GRPCHealthService string `yaml:"grpc_health_service"`
+	// ReadTimeout, WriteTimeout and ClientMaxBodySize override the global ones
+	ReadTimeout       uint   `yaml:"read_timeout"`
+	WriteTimeout      uint   `yaml:"write_timeout"`
+	ClientMaxBodySize uint64 `yaml:"client_max_body_size"`
+}
+
+// Mirror details of the shadow pool receiving a copy of the requests of a location
+type Mirror struct {
+	ProxyPass   []string `yaml:"proxy_pass"`
+	BalanceMode string   `yaml:"balance_mode"`
+	Percentage  float64  `yaml:"percentage"`
+	MaxBodySize int64    `yaml:"max_body_size"`
+	// Timeout bounds each mirrored request (second), 0 keeps 10
+	Timeout     uint `yaml:"timeout"`
+	MaxInflight int  `yaml:"max_inflight"`
+}
+
+// Cache details of the response cache of a location, the responses are kept
+// in memory, or in files of path for the disk store. The locations with groups
+// are not cached, a group would receive the responses of the others.
+type Cache struct {
+	Enabled bool   `yaml:"enabled"`
+	Store   string `yaml:"store"`
+	Path    string `yaml:"path"`
+	// MaxBytes bounds the store, MaxObjectSize each response (byte)
+	MaxBytes      int64 `yaml:"max_bytes"`
+	MaxObjectSize int64 `yaml:"max_object_size"`
+}
+
+// Compression details of the compression of the responses of a location,
+// the encoding is negotiated from Accept-Encoding
+type Compression struct {
+	Enabled   bool     `yaml:"enabled"`
+	Encodings []string `yaml:"encodings"`
+	Types     []string `yaml:"types"`
+	// MinSize bounds the responses compressed (byte)
+	MinSize int `yaml:"min_size"`
+}
+
+// ErrorPages details of the error responses of the balancer for a location,
+// the statuses without page are written in the format, text, html or json
+type ErrorPages struct {
+	Format string             `yaml:"format"`
+	Pages  map[int]*ErrorPage `yaml:"pages"`
+}
+
+// ErrorPage a static file, or a template executed with the status, the
+// status text, the message and the request id
+type ErrorPage struct {
+	File     string `yaml:"file"`
+	Template bool   `yaml:"template"`
+}
+
+// Group a backend group of a location, such as stable or canary, the
+// requests matching no split rule are shared by weight
+type Group struct {
+	Name        string   `yaml:"name"`
+	ProxyPass   []string `yaml:"proxy_pass"`
+	BalanceMode string   `yaml:"balance_mode"`
+	Weight      uint     `yaml:"weight"`
+}
+
+// SplitRule sends the requests with a header or a cookie to a group, an
+// empty value matches any value
+type SplitRule struct {
+	Header string `yaml:"header"`
+	Cookie string `yaml:"cookie"`
+	Value  string `yaml:"value"`
+	Group  string `yaml:"group"`
+}
+
+// HeaderRules headers removed, set and appended, in that order, the values may
+// refer to $client_ip, $backend, $request_id, $host and $scheme
+type HeaderRules struct {
+	Remove []string          `yaml:"remove"`
+	Set    map[string]string `yaml:"set"`
+	Append map[string]string `yaml:"append"`
+}
+
+// Rewrite details of the path and the Host header of the upstream requests,
+// the prefix is stripped, then the rules are applied in order and the prefix is added
+type Rewrite struct {
+	StripPrefix string         `yaml:"strip_prefix"`
+	AddPrefix   string         `yaml:"add_prefix"`
+	Rules       []*RewriteRule `yaml:"rules"`
+	// Host overrides the Host header, $backend refers to the host of the backend
+	Host string `yaml:"host"`
+}
+
+// RewriteRule a regex rewrite of the path, the replacement may refer to groups such as $1
+type RewriteRule struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+// TCP connection details of a location served by a tcp listener
+type TCP struct {
+	// IdleTimeout closes the connections without bytes in either direction (second)
+	IdleTimeout uint `yaml:"idle_timeout"`
+}
+
+// UDP session details of a location served by a udp listener
+type UDP struct {
+	// IdleTimeout ends the session of a client without datagrams (second)
+	IdleTimeout uint `yaml:"idle_timeout"`
+	MaxSessions int  `yaml:"max_sessions"`
+	// HealthCheck checks the hosts with tcp connections, for the backends
+	// also listening on tcp, such as dns
+	HealthCheck bool `yaml:"health_check"`
+}
+
+// Upgrade details of the upgraded connections of a location, such as
+// WebSockets, the timeouts are in seconds
+type Upgrade struct {
+	BalanceMode   string `yaml:"balance_mode"`
+	IdleTimeout   uint   `yaml:"idle_timeout"`
+	KeepAlive     uint   `yaml:"keep_alive"`
+	CloseOnRemove bool   `yaml:"close_on_remove"`
+	DrainTimeout  uint   `yaml:"drain_timeout"`
+}
+
+// Transport connection pool details to the backends of a location,
+// the timeouts are in seconds and zero values keep the defaults
+type Transport struct {
+	MaxIdleConnsPerHost   int  `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int  `yaml:"max_conns_per_host"`
+	IdleConnTimeout       uint `yaml:"idle_conn_timeout"`
+	DialTimeout           uint `yaml:"dial_timeout"`
+	TLSHandshakeTimeout   uint `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout uint `yaml:"response_header_timeout"`
+	KeepAlive             uint `yaml:"keep_alive"`
+	DisableHTTP2          bool `yaml:"disable_http2"`
+	DisableCompression    bool `yaml:"disable_compression"`
+}
+
+// UpstreamTLS tls details of the connections to https backends
+type UpstreamTLS struct {
+	CA                 string `yaml:"ca"`
+	Certificate        string `yaml:"certificate"`
+	Key                string `yaml:"key"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 }
 
 // ReadConfig read configuration from `fileName` file
@@ -43,25 +333,337 @@ func ReadConfig(fileName string) (*Config, error) {
 
 // Print print config details
 func (c *Config) Print() {
-	fmt.Printf("Schema: %s\nPort: %d\nHealth Check: %v\nLocation:\n", c.Schema, c.Port, c.HealthCheck)
+	fmt.Printf("Health Check: %v\nListener:\n", c.HealthCheck)
+	for _, l := range c.Listeners {
+		fmt.Printf("\tName: %s\n\tAddress: %s\n\tSchema: %s\n\tLocations: %s\n\n", l.Name, l.Address, l.Schema, l.Locations)
+	}
+	fmt.Printf("Location:\n")
 	for _, l := range c.Location {
-		fmt.Printf("\tRoute: %s\n\tProxy Pass: %s\n\tMode: %s\n\n", l.Pattern, l.ProxyPass, l.BalanceMode)
+		fmt.Printf("\tName: %s\n\tRoute: %s\n\tProxy Pass: %s\n\tMode: %s\n\n", l.Name, l.Pattern, l.ProxyPass, l.BalanceMode)
 	}
 }
 
 // Validation verify the configuration details of the balancer
 func (c *Config) Validation() error {
-	if c.Schema != "http" && c.Schema != "https" {
-		return fmt.Errorf("the schema \"%s\" not supported", c.Schema)
-	}
 	if len(c.Location) == 0 {
 		return errors.New("the details of location cannot be null")
 	}
-	if c.Schema == "https" && (len(c.SSLCertificate) == 0 || len(c.SSLCertificateKey) == 0) {
-		return errors.New("the https proxy requires ssl_certificate_key and ssl_certificate")
+	for _, l := range c.Location {
+		if len(l.Name) == 0 {
+			l.Name = l.Pattern
+		}
+	}
+	// the top level schema and port describe a single listener
+	if len(c.Listeners) == 0 {
+		c.Listeners = []*Listener{{
+			Address:             ":" + strconv.Itoa(c.Port),
+			Schema:              c.Schema,
+			SSLCertificate:      c.SSLCertificate,
+			SSLCertificateKey:   c.SSLCertificateKey,
+			AcceptProxyProtocol: c.AcceptProxyProtocol,
+			HSTS:                c.HSTS,
+			H2C:                 c.H2C,
+
+			Certificates:              c.Certificates,
+			CertificateReloadInterval: c.CertificateReloadInterval,
+			TLS:                       c.TLS,
+		}}
+		if c.Schema == "https" && c.Redirect != nil && c.Redirect.Enabled {
+			redirect := *c.Redirect
+			if len(redirect.Address) == 0 {
+				redirect.Address = ":80"
+			}
+			if redirect.Port == 0 {
+				redirect.Port = c.Port
+			}
+			c.Listeners = append(c.Listeners, &Listener{
+				Name:     "redirect",
+				Address:  redirect.Address,
+				Schema:   "http",
+				Redirect: &redirect,
+			})
+		}
+	}
+	if err := c.validateListeners(); err != nil {
+		return err
+	}
+	if c.MaxHeaderBytes < 0 {
+		return errors.New("max_header_bytes cannot be negative")
 	}
 	if c.HealthCheckInterval < 1 {
 		return errors.New("health_check_interval must be greater than 0")
 	}
+	if c.AdaptiveLimit != nil && c.AdaptiveLimit.Enabled {
+		l := c.AdaptiveLimit
+		if l.Algorithm != "aimd" && l.Algorithm != "gradient" {
+			return fmt.Errorf("the adaptive limit algorithm \"%s\" not supported", l.Algorithm)
+		}
+		if l.MinLimit < 1 || l.MaxLimit < l.MinLimit {
+			return errors.New("adaptive_limit requires 0 < min_limit <= max_limit")
+		}
+		if l.InitialLimit < l.MinLimit || l.InitialLimit > l.MaxLimit {
+			return errors.New("adaptive_limit initial_limit must be between min_limit and max_limit")
+		}
+	}
+	if c.AccessLog != nil && c.AccessLog.Enabled {
+		if c.AccessLog.Format != "json" && c.AccessLog.Format != "combined" {
+			return fmt.Errorf("the access log format \"%s\" not supported", c.AccessLog.Format)
+		}
+		if len(c.AccessLog.Path) == 0 {
+			return errors.New("access_log requires path, use stdout to log to the standard output")
+		}
+	}
+	names := make(map[string]bool)
+	for _, l := range c.Location {
+		if names[l.Name] {
+			return fmt.Errorf("the location name \"%s\" is duplicated, set a distinct name", l.Name)
+		}
+		names[l.Name] = true
+		if l.PathMatch != "" && l.PathMatch != "exact" && l.PathMatch != "prefix" && l.PathMatch != "regex" {
+			return fmt.Errorf("the path match \"%s\" of location %s not supported", l.PathMatch, l.Name)
+		}
+		if l.PathMatch == "regex" {
+			if _, err := regexp.Compile(l.Pattern); err != nil {
+				return fmt.Errorf("the pattern of location %s is not a valid regex: %s", l.Name, err)
+			}
+		}
+		if m := l.Mirror; m != nil {
+			if len(m.ProxyPass) == 0 {
+				return fmt.Errorf("the mirror of location %s requires proxy_pass", l.Name)
+			}
+			if m.Percentage < 0 || m.Percentage > 100 {
+				return fmt.Errorf("the mirror percentage of location %s must be between 0 and 100", l.Name)
+			}
+			if len(m.BalanceMode) == 0 {
+				m.BalanceMode = l.BalanceMode
+			}
+		}
+		if ca := l.Cache; ca != nil && ca.Enabled {
+			if len(l.Groups) != 0 {
+				return fmt.Errorf("the location %s has groups, its responses cannot be cached", l.Name)
+			}
+			if len(ca.Store) == 0 {
+				ca.Store = "memory"
+			}
+			if ca.Store != "memory" && ca.Store != "disk" {
+				return fmt.Errorf("the cache store \"%s\" of location %s not supported", ca.Store, l.Name)
+			}
+			if ca.Store == "disk" && len(ca.Path) == 0 {
+				return fmt.Errorf("the disk cache of location %s requires path", l.Name)
+			}
+			if ca.MaxBytes < 0 || ca.MaxObjectSize < 0 {
+				return fmt.Errorf("the cache of location %s requires positive sizes", l.Name)
+			}
+			if ca.MaxBytes == 0 {
+				ca.MaxBytes = 64 << 20
+			}
+		}
+		if co := l.Compression; co != nil && co.Enabled {
+			for _, encoding := range co.Encodings {
+				if encoding != "gzip" && encoding != "br" && encoding != "zstd" {
+					return fmt.Errorf("the encoding \"%s\" of location %s not supported", encoding, l.Name)
+				}
+			}
+			if co.MinSize < 0 {
+				return fmt.Errorf("the compression of location %s requires a positive min_size", l.Name)
+			}
+		}
+		if e := l.ErrorPages; e != nil {
+			if e.Format != "" && e.Format != "text" && e.Format != "html" && e.Format != "json" {
+				return fmt.Errorf("the error format \"%s\" of location %s not supported", e.Format, l.Name)
+			}
+			for status, page := range e.Pages {
+				if status < 400 || status > 599 || page == nil || len(page.File) == 0 {
+					return fmt.Errorf("the error page %d of location %s requires an error status and a file", status, l.Name)
+				}
+			}
+		}
+		if err := l.validateGroups(); err != nil {
+			return err
+		}
+		if l.Rewrite != nil {
+			for _, rule := range l.Rewrite.Rules {
+				if _, err := regexp.Compile(rule.Regex); err != nil {
+					return fmt.Errorf("the rewrite rule \"%s\" of location %s is not a valid regex: %s", rule.Regex, l.Name, err)
+				}
+			}
+		}
+		if l.SendProxyProtocol != "" && l.SendProxyProtocol != "v1" && l.SendProxyProtocol != "v2" {
+			return fmt.Errorf("the proxy protocol version \"%s\" not supported", l.SendProxyProtocol)
+		}
+		if l.UDP != nil && l.UDP.MaxSessions < 0 {
+			return fmt.Errorf("the udp sessions of location %s require a positive max_sessions", l.Name)
+		}
+		if t := l.Transport; t != nil && (t.MaxIdleConnsPerHost < 0 || t.MaxConnsPerHost < 0) {
+			return fmt.Errorf("the transport of location %s requires positive connection limits", l.Name)
+		}
+		if t := l.UpstreamTLS; t != nil && (len(t.Certificate) == 0) != (len(t.Key) == 0) {
+			return fmt.Errorf("the upstream tls of location %s requires both certificate and key", l.Name)
+		}
+	}
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return fmt.Errorf("the trusted proxy \"%s\" is not a valid CIDR or IP", p)
+		}
+	}
+	if c.Tracing != nil && c.Tracing.Enabled {
+		if len(c.Tracing.Endpoint) == 0 {
+			return errors.New("tracing requires endpoint")
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			return errors.New("tracing sample_ratio must be between 0 and 1")
+		}
+		if len(c.Tracing.ServiceName) == 0 {
+			c.Tracing.ServiceName = "go-balancer"
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateListeners() error {
+	names := make(map[string]bool)
+	for _, l := range c.Location {
+		names[l.Name] = true
+	}
+	// a tcp or udp listener proxies the connections to a single location,
+	// which is not served by the http listeners
+	layer4Names := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if len(l.Name) == 0 {
+			l.Name = l.Address
+		}
+		if !l.IsLayer4() {
+			continue
+		}
+		if len(l.Locations) == 0 && len(c.Location) == 1 {
+			l.Locations = []string{c.Location[0].Name}
+		}
+		if len(l.Locations) != 1 {
+			return fmt.Errorf("the %s listener %s must refer to a single location", l.Schema, l.Name)
+		}
+		layer4Names[l.Locations[0]] = true
+	}
+	for _, l := range c.Location {
+		if layer4Names[l.Name] && len(l.Groups) != 0 {
+			return fmt.Errorf("the location %s of a tcp or udp listener cannot have groups", l.Name)
+		}
+	}
+	for _, l := range c.Listeners {
+		if l.Schema != "http" && l.Schema != "https" && !l.IsLayer4() {
+			return fmt.Errorf("the schema \"%s\" of listener %s not supported", l.Schema, l.Name)
+		}
+		if !l.IsLayer4() {
+			if len(l.Locations) == 0 {
+				for _, location := range c.Location {
+					if !layer4Names[location.Name] {
+						l.Locations = append(l.Locations, location.Name)
+					}
+				}
+			}
+			for _, name := range l.Locations {
+				if layer4Names[name] {
+					return fmt.Errorf("the location \"%s\" of listener %s is served by a tcp or udp listener", name, l.Name)
+				}
+			}
+		}
+		if l.Schema == "udp" && l.AcceptProxyProtocol {
+			return fmt.Errorf("the udp listener %s cannot accept the proxy protocol", l.Name)
+		}
+		if len(l.Address) == 0 {
+			return fmt.Errorf("the listener %s requires address", l.Name)
+		}
+		if l.Schema == "https" && len(l.CertificatePairs()) == 0 {
+			return fmt.Errorf("the https listener %s requires ssl_certificate_key and ssl_certificate, or certificates", l.Name)
+		}
+		for _, cert := range l.Certificates {
+			if len(cert.Certificate) == 0 || len(cert.Key) == 0 {
+				return fmt.Errorf("the certificates of listener %s require certificate and key", l.Name)
+			}
+		}
+		if l.Redirect != nil && l.Redirect.Enabled {
+			if l.Schema != "http" {
+				return fmt.Errorf("the listener %s redirects to https, its schema must be http", l.Name)
+			}
+			if l.Redirect.Status == 0 {
+				l.Redirect.Status = http.StatusMovedPermanently
+			}
+			if l.Redirect.Status != http.StatusMovedPermanently && l.Redirect.Status != http.StatusPermanentRedirect {
+				return fmt.Errorf("the redirect status %d of listener %s not supported", l.Redirect.Status, l.Name)
+			}
+		}
+		if l.TLS != nil {
+			if l.Schema != "https" {
+				return fmt.Errorf("the listener %s has a tls policy, its schema must be https", l.Name)
+			}
+			if l.TLS.ClientAuth != "" && l.TLS.ClientAuth != "none" && len(l.TLS.ClientCA) == 0 {
+				return fmt.Errorf("the client auth of listener %s requires client_ca", l.Name)
+			}
+		}
+		if l.H2C && l.Schema != "http" {
+			return fmt.Errorf("the listener %s serves h2c, its schema must be http", l.Name)
+		}
+		if l.HSTS != nil && l.HSTS.Enabled && l.Schema != "https" {
+			return fmt.Errorf("the listener %s sends hsts, its schema must be https", l.Name)
+		}
+		for _, name := range l.Locations {
+			if !names[name] {
+				return fmt.Errorf("the listener %s refers to unknown location \"%s\"", l.Name, name)
+			}
+		}
+	}
 	return nil
 }
+
+// validateGroups verifies the backend groups and the split rules of the location
+func (l *Location) validateGroups() error {
+	if len(l.Groups) == 0 {
+		if len(l.SplitRules) != 0 {
+			return fmt.Errorf("the location %s has split rules without groups", l.Name)
+		}
+		return nil
+	}
+	if len(l.ProxyPass) != 0 {
+		return fmt.Errorf("the location %s has groups, they replace proxy_pass", l.Name)
+	}
+	groups := make(map[string]bool)
+	var total uint
+	for _, g := range l.Groups {
+		if len(g.Name) == 0 || groups[g.Name] {
+			return fmt.Errorf("the groups of location %s require distinct names", l.Name)
+		}
+		groups[g.Name] = true
+		if len(g.ProxyPass) == 0 {
+			return fmt.Errorf("the group %s of location %s requires proxy_pass", g.Name, l.Name)
+		}
+		if len(g.BalanceMode) == 0 {
+			g.BalanceMode = l.BalanceMode
+		}
+		total += g.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("the groups of location %s require a positive weight", l.Name)
+	}
+	for _, r := range l.SplitRules {
+		if (len(r.Header) == 0) == (len(r.Cookie) == 0) {
+			return fmt.Errorf("the split rules of location %s require either header or cookie", l.Name)
+		}
+		if !groups[r.Group] {
+			return fmt.Errorf("the split rule of location %s refers to unknown group \"%s\"", l.Name, r.Group)
+		}
+	}
+	return nil
+}
+
+// CertificatePairs returns the certificates of the listener, the default one first
+func (l *Listener) CertificatePairs() []*Certificate {
+	pairs := make([]*Certificate, 0, len(l.Certificates)+1)
+	if len(l.SSLCertificate) != 0 && len(l.SSLCertificateKey) != 0 {
+		pairs = append(pairs, &Certificate{Certificate: l.SSLCertificate, Key: l.SSLCertificateKey})
+	}
+	return append(pairs, l.Certificates...)
+}
+
+// IsLayer4 reports whether the listener proxies tcp connections or udp datagrams
+func (l *Listener) IsLayer4() bool {
+	return l.Schema == "tcp" || l.Schema == "udp"
+}
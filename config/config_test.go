@@ -0,0 +1,114 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newConfig returns a valid configuration of a https listener
+func newConfig() *Config {
+	return &Config{
+		Schema:              "https",
+		Port:                443,
+		SSLCertificate:      "cert.pem",
+		SSLCertificateKey:   "key.pem",
+		HealthCheckInterval: 1,
+		Location: []*Location{{
+			Pattern:     "/",
+			ProxyPass:   []string{"http://192.168.1.1"},
+			BalanceMode: "round-robin",
+		}},
+	}
+}
+
+func TestValidation_Redirect(t *testing.T) {
+	cases := []struct {
+		name     string
+		schema   string
+		redirect *Redirect
+		expect   *Listener
+	}{
+		{"defaults", "https", &Redirect{Enabled: true}, &Listener{
+			Name: "redirect", Address: ":80", Schema: "http", Locations: []string{"/"},
+			Redirect: &Redirect{Enabled: true, Address: ":80", Port: 443, Status: http.StatusMovedPermanently},
+		}},
+		{"configured", "https", &Redirect{Enabled: true, Address: ":8080", Port: 8443, Status: http.StatusPermanentRedirect}, &Listener{
+			Name: "redirect", Address: ":8080", Schema: "http", Locations: []string{"/"},
+			Redirect: &Redirect{Enabled: true, Address: ":8080", Port: 8443, Status: http.StatusPermanentRedirect},
+		}},
+		{"disabled", "https", &Redirect{}, nil},
+		{"http schema", "http", &Redirect{Enabled: true}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := newConfig()
+			config.Schema = c.schema
+			config.Redirect = c.redirect
+			assert.Nil(t, config.Validation())
+
+			assert.Equal(t, ":443", config.Listeners[0].Address)
+			assert.Equal(t, c.schema, config.Listeners[0].Schema)
+			if c.expect == nil {
+				assert.Len(t, config.Listeners, 1)
+				return
+			}
+			assert.Len(t, config.Listeners, 2)
+			assert.Equal(t, c.expect, config.Listeners[1])
+			// the configuration of the balancer is left as is
+			assert.NotSame(t, config.Redirect, config.Listeners[1].Redirect)
+		})
+	}
+}
+
+func TestValidation_Errors(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"redirect status", func(c *Config) {
+			c.Redirect = &Redirect{Enabled: true, Status: http.StatusFound}
+		}, "the redirect status 302 of listener redirect not supported"},
+		{"missing certificate", func(c *Config) {
+			c.SSLCertificate = ""
+		}, "the https listener :443 requires ssl_certificate_key and ssl_certificate, or certificates"},
+		{"incomplete certificates", func(c *Config) {
+			c.Certificates = []*Certificate{{Certificate: "other.pem"}}
+		}, "the certificates of listener :443 require certificate and key"},
+		{"rewrite regex", func(c *Config) {
+			c.Location[0].Rewrite = &Rewrite{Rules: []*RewriteRule{{Regex: "(", Replacement: "/"}}}
+		}, "the rewrite rule \"(\" of location / is not a valid regex"},
+		{"tls policy of http", func(c *Config) {
+			c.Schema = "http"
+			c.TLS = &TLS{MinVersion: "1.2"}
+		}, "the listener :443 has a tls policy, its schema must be https"},
+		{"client auth without ca", func(c *Config) {
+			c.TLS = &TLS{ClientAuth: "require"}
+		}, "the client auth of listener :443 requires client_ca"},
+		{"hsts of http", func(c *Config) {
+			c.Schema = "http"
+			c.HSTS = &HSTS{Enabled: true}
+		}, "the listener :443 sends hsts, its schema must be https"},
+		{"cache of groups", func(c *Config) {
+			c.Location[0].ProxyPass = nil
+			c.Location[0].Groups = []*Group{{Name: "stable", ProxyPass: []string{"http://192.168.1.1"}, Weight: 100}}
+			c.Location[0].Cache = &Cache{Enabled: true}
+		}, "the location / has groups, its responses cannot be cached"},
+		{"unknown location", func(c *Config) {
+			c.Listeners = []*Listener{{Address: ":80", Schema: "http", Locations: []string{"/api"}}}
+		}, "the listener :80 refers to unknown location \"/api\""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := newConfig()
+			c.modify(config)
+			err := config.Validation()
+			assert.NotNil(t, err)
+			if err != nil {
+				assert.Contains(t, err.Error(), c.err)
+			}
+		})
+	}
+}
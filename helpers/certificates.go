@@ -0,0 +1,152 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var NoCertificateError = errors.New("no certificate")
+
+// CertPair refers to the files of a certificate and its private key
+type CertPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore selects a certificate by SNI among several certificates, and
+// reloads them when their files change on disk
+type CertStore struct {
+	sync.RWMutex
+	pairs    []CertPair
+	modTimes []time.Time
+	certs    []*tls.Certificate
+	names    map[string]*tls.Certificate
+}
+
+// NewCertStore create new CertStore, the first pair is the default
+// certificate for clients without SNI or with an unknown server name
+func NewCertStore(pairs []CertPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, NoCertificateError
+	}
+	s := &CertStore{
+		pairs:    pairs,
+		modTimes: make([]time.Time, len(pairs)),
+		certs:    make([]*tls.Certificate, len(pairs)),
+	}
+	for i := range pairs {
+		if err := s.load(i); err != nil {
+			return nil, err
+		}
+	}
+	s.index()
+	return s, nil
+}
+
+// load reads the i-th certificate from disk
+func (s *CertStore) load(i int) error {
+	cert, err := tls.LoadX509KeyPair(s.pairs[i].CertFile, s.pairs[i].KeyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	s.certs[i] = &cert
+	s.modTimes[i] = s.modTime(i)
+	return nil
+}
+
+// modTime returns the latest modification time of the files of the i-th pair
+func (s *CertStore) modTime(i int) time.Time {
+	var latest time.Time
+	for _, file := range []string{s.pairs[i].CertFile, s.pairs[i].KeyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// index maps the names of the certificates to them, the first certificate
+// listing a name wins
+func (s *CertStore) index() {
+	names := make(map[string]*tls.Certificate)
+	for _, cert := range s.certs {
+		leafNames := cert.Leaf.DNSNames
+		if len(leafNames) == 0 && len(cert.Leaf.Subject.CommonName) != 0 {
+			leafNames = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range leafNames {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok {
+				names[name] = cert
+			}
+		}
+	}
+	s.names = names
+}
+
+// GetCertificate implements tls.Config.GetCertificate, an exact name is
+// preferred to a wildcard `*.example.com` covering a single label
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.names[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i != -1 {
+		if cert, ok := s.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// Reload reads again the certificates whose files changed, a certificate
+// that fails to load keeps being served
+func (s *CertStore) Reload() error {
+	s.Lock()
+	defer s.Unlock()
+
+	var err error
+	changed := false
+	for i := range s.pairs {
+		if !s.modTime(i).After(s.modTimes[i]) {
+			continue
+		}
+		if e := s.load(i); e != nil {
+			err = e
+			continue
+		}
+		changed = true
+		log.Printf("Certificate %s is reloaded.", s.pairs[i].CertFile)
+	}
+	if changed {
+		s.index()
+	}
+	return err
+}
+
+// Watch enable a goroutine reloading the certificates every `interval` seconds
+func (s *CertStore) Watch(interval uint) {
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		for range ticker.C {
+			if err := s.Reload(); err != nil {
+				log.Printf("reload certificate error: %s", err)
+			}
+		}
+	}()
+}
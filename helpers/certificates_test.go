@@ -0,0 +1,88 @@
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self-signed certificate for `names` to `dir`
+func writeCert(t *testing.T, dir, file string, names ...string) CertPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	pair := CertPair{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	assert.Nil(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return pair
+}
+
+func TestCertStore_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCertStore([]CertPair{
+		writeCert(t, dir, "default", "default.com"),
+		writeCert(t, dir, "exact", "api.example.com"),
+		writeCert(t, dir, "wildcard", "*.example.com"),
+	})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		name       string
+		serverName string
+		expect     string
+	}{
+		{"exact", "api.example.com", "api.example.com"},
+		{"case", "API.Example.com.", "api.example.com"},
+		{"wildcard", "www.example.com", "*.example.com"},
+		{"wildcard single label", "a.b.example.com", "default.com"},
+		{"no sni", "", "default.com"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+			assert.Nil(t, err)
+			assert.Equal(t, c.expect, cert.Leaf.DNSNames[0])
+		})
+	}
+}
+
+func TestCertStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCertStore([]CertPair{writeCert(t, dir, "site", "old.com")})
+	assert.Nil(t, err)
+
+	writeCert(t, dir, "site", "new.com")
+	// make sure the modification time moves forward on coarse file systems
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "site.crt"), future, future))
+	assert.Nil(t, store.Reload())
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "new.com", cert.Leaf.DNSNames[0])
+}
@@ -0,0 +1,347 @@
+package helpers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressEncodings are the supported encodings, in order of preference
+var DefaultCompressEncodings = []string{"br", "zstd", "gzip"}
+
+// DefaultCompressTypes are the MIME types compressed by default
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// DefaultCompressMinSize is the size of the smallest response compressed by default
+const DefaultCompressMinSize = 1024
+
+// CompressConfig refers to the compression of the responses of a location
+type CompressConfig struct {
+	// Encodings offered to the clients, in order of preference, among br, zstd and gzip
+	Encodings []string
+	// Types are the compressed MIME types, `text/*` matches any text type
+	Types []string
+	// MinSize bounds the responses compressed, smaller ones are sent as is,
+	// 0 keeps DefaultCompressMinSize
+	MinSize int
+}
+
+// encoder compresses a response, it is reused between responses
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type zstdEncoder struct {
+	*zstd.Encoder
+}
+
+func (e zstdEncoder) Reset(w io.Writer) {
+	e.Encoder.Reset(w)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	"zstd": {New: func() interface{} {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return zstdEncoder{e}
+	}},
+}
+
+// negotiateEncoding returns the encoding of the response, the preferred one
+// of `encodings` among the best ones accepted by the client, or empty
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				q = v
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether the MIME type of the content is in `types`
+func compressible(contentType string, types []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if len(mediaType) == 0 {
+		return false
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds the header to the Vary header unless it is already listed
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.EqualFold(v, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// CompressMiddleware compresses the responses with the encoding negotiated
+// from `Accept-Encoding`. The responses already encoded, smaller than MinSize
+// or of other types are sent as is.
+func CompressMiddleware(config CompressConfig) mux.MiddlewareFunc {
+	if len(config.Encodings) == 0 {
+		config.Encodings = DefaultCompressEncodings
+	}
+	if len(config.Types) == 0 {
+		config.Types = DefaultCompressTypes
+	}
+	if config.MinSize <= 0 {
+		config.MinSize = DefaultCompressMinSize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), config.Encodings)
+			// partial content and the responses to HEAD keep the identity encoding
+			if r.Method == http.MethodHead || len(r.Header.Get("Range")) != 0 {
+				encoding = ""
+			}
+			if len(r.Header.Get("Upgrade")) != 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// the backend validates the tags it sent, before they were weakened
+			match := r.Header.Get("If-None-Match")
+			if len(match) != 0 {
+				r.Header.Set("If-None-Match", strongETags(match))
+			}
+			cw := &compressWriter{ResponseWriter: w, config: &config, encoding: encoding,
+				weakMatch: strings.Contains(match, "W/")}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// weakenETag marks the ETag of the response weak
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); len(etag) != 0 && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// strongETags removes the weak marks of the tags of `If-None-Match`, which
+// are compared weakly anyway
+func strongETags(match string) string {
+	tags := strings.Split(match, ",")
+	for i, tag := range tags {
+		tags[i] = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	}
+	return strings.Join(tags, ", ")
+}
+
+// compressWriter buffers the beginning of the response until it is known
+// whether it is compressed
+type compressWriter struct {
+	http.ResponseWriter
+	config   *CompressConfig
+	encoding string
+	// weakMatch reports the client revalidates weak tags
+	weakMatch bool
+
+	status  int
+	pending bool
+	done    bool
+	buf     []byte
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+
+	header := cw.Header()
+	// the client revalidates the tag of the compressed representation
+	if status == http.StatusNotModified && cw.weakMatch {
+		weakenETag(header)
+	}
+	encoded := len(header.Get("Content-Encoding")) != 0 && !strings.EqualFold(header.Get("Content-Encoding"), "identity")
+	if encoded || !compressible(header.Get("Content-Type"), cw.config.Types) {
+		cw.send()
+		return
+	}
+	// the representation depends on the encodings accepted by the client
+	addVary(header, "Accept-Encoding")
+	if len(cw.encoding) == 0 || status == http.StatusNoContent ||
+		status == http.StatusPartialContent || status == http.StatusNotModified ||
+		strings.Contains(strings.ToLower(strings.Join(header.Values("Cache-Control"), ",")), "no-transform") {
+		cw.send()
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		if length < cw.config.MinSize {
+			cw.send()
+		} else {
+			cw.compress()
+		}
+		return
+	}
+	cw.pending = true
+}
+
+// send writes the response as is
+func (cw *compressWriter) send() {
+	cw.pending = false
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// compress writes the response with the encoding
+func (cw *compressWriter) compress() {
+	cw.pending = false
+	header := cw.Header()
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	// the compressed representation is not byte for byte the same
+	weakenETag(header)
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.enc = encoderPools[cw.encoding].Get().(encoder)
+	cw.enc.Reset(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		if len(cw.Header().Get("Content-Type")) == 0 {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.pending {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.config.MinSize {
+			return len(b), nil
+		}
+		cw.compress()
+		buf := cw.buf
+		cw.buf = nil
+		if _, err := cw.enc.Write(buf); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, a streaming response is compressed at once
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.pending {
+		cw.compress()
+		buf := cw.buf
+		cw.buf = nil
+		_, _ = cw.enc.Write(buf)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, it is required for upgraded connections
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the original http.ResponseWriter for http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close sends the response smaller than MinSize and ends the compressed one
+func (cw *compressWriter) close() {
+	if cw.done {
+		return
+	}
+	cw.done = true
+	if cw.pending {
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		cw.send()
+		_, _ = cw.ResponseWriter.Write(cw.buf)
+		return
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+		cw.enc.Reset(nil)
+		encoderPools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
@@ -0,0 +1,166 @@
+package helpers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		expect         string
+	}{
+		{"none", "", ""},
+		{"gzip", "gzip, deflate", "gzip"},
+		{"preference", "gzip, br, zstd", "br"},
+		{"quality", "br;q=0.5, gzip", "gzip"},
+		{"refused", "br;q=0, zstd;q=0, gzip;q=0", ""},
+		{"wildcard", "*", "br"},
+		{"wildcard refused", "*;q=0, gzip", "gzip"},
+		{"identity", "identity", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, negotiateEncoding(c.acceptEncoding, DefaultCompressEncodings))
+		})
+	}
+}
+
+func decode(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		r, err = zstd.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	assert.Nil(t, err)
+	decoded, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return string(decoded)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	large := strings.Repeat("hello world ", 200)
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		header         map[string]string
+		body           string
+		encoding       string
+		vary           string
+	}{
+		{"gzip", "gzip", map[string]string{"Content-Type": "text/html"}, large, "gzip", "Accept-Encoding"},
+		{"brotli", "br, gzip", map[string]string{"Content-Type": "application/json"}, large, "br", "Accept-Encoding"},
+		{"zstd", "zstd", map[string]string{"Content-Type": "text/plain; charset=utf-8"}, large, "zstd", "Accept-Encoding"},
+		{"sniffed type", "gzip", nil, large, "gzip", "Accept-Encoding"},
+		{"not accepted", "", map[string]string{"Content-Type": "text/html"}, large, "", "Accept-Encoding"},
+		{"small", "gzip", map[string]string{"Content-Type": "text/html"}, "hello", "", "Accept-Encoding"},
+		{"small with length", "gzip", map[string]string{"Content-Type": "text/html", "Content-Length": "5"}, "hello", "", "Accept-Encoding"},
+		{"type not allowed", "gzip", map[string]string{"Content-Type": "image/png"}, large, "", ""},
+		{"already encoded", "gzip", map[string]string{"Content-Type": "text/html", "Content-Encoding": "br"}, large, "br", ""},
+		{"no transform", "gzip", map[string]string{"Content-Type": "text/html", "Cache-Control": "no-transform"}, large, "", "Accept-Encoding"},
+		{"vary kept", "gzip", map[string]string{"Content-Type": "text/html", "Vary": "Accept-Encoding"}, large, "gzip", "Accept-Encoding"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler := CompressMiddleware(CompressConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for key, value := range c.header {
+					w.Header().Set(key, value)
+				}
+				// the body is written in small chunks
+				for i := 0; i < len(c.body); i += 100 {
+					_, _ = w.Write([]byte(c.body[i:min(i+100, len(c.body))]))
+				}
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", c.acceptEncoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, c.encoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, c.vary, strings.Join(w.Header().Values("Vary"), ", "))
+			if c.encoding != "" && c.encoding != c.header["Content-Encoding"] {
+				assert.Empty(t, w.Header().Get("Content-Length"))
+				assert.Less(t, w.Body.Len(), len(c.body))
+				assert.Equal(t, c.body, decode(t, c.encoding, w.Body.Bytes()))
+			} else {
+				assert.Equal(t, c.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCompressMiddleware_Reuse(t *testing.T) {
+	handler := CompressMiddleware(CompressConfig{Encodings: []string{"gzip", "zstd"}, MinSize: 10})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = w.Write([]byte(strings.Repeat(r.URL.Path, 100)))
+		}))
+	// the encoders of the pools are reset between responses
+	for i := 0; i < 10; i++ {
+		for _, encoding := range []string{"gzip", "zstd"} {
+			path := "/" + strconv.Itoa(i)
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+			assert.Equal(t, strings.Repeat(path, 100), decode(t, encoding, w.Body.Bytes()))
+		}
+	}
+}
+
+func TestCompressMiddleware_Revalidation(t *testing.T) {
+	handler := CompressMiddleware(CompressConfig{MinSize: 10})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v0", "v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+		}))
+
+	cases := []struct {
+		name   string
+		match  string
+		status int
+		etag   string
+	}{
+		{"weak tag of the compressed response", `"v0", W/"v1"`, http.StatusNotModified, `W/"v1"`},
+		{"strong tag", `"v0", "v1"`, http.StatusNotModified, `"v1"`},
+		{"unknown tag", `W/"v2"`, http.StatusOK, `W/"v1"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			r.Header.Set("If-None-Match", c.match)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, c.status, w.Code)
+			assert.Equal(t, c.etag, w.Header().Get("ETag"))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// StrictTransportSecurity is the header enabling HSTS
+var StrictTransportSecurity = http.CanonicalHeaderKey("Strict-Transport-Security")
+
+// HTTPSRedirectMiddleware redirects the requests to https with `status`,
+// preserving the path and query. `port` is the https port of the redirect,
+// 0 or 443 leave it out. Requests whose path starts with one of the
+// `exceptions`, such as ACME challenges, are passed to the next handler.
+func HTTPSRedirectMiddleware(port int, status int, exceptions []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range exceptions {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if port != 0 && port != 443 {
+				host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+			} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+				host = "[" + host + "]"
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+		})
+	}
+}
+
+// HSTSMiddleware adds the `Strict-Transport-Security` header to the responses
+func HSTSMiddleware(maxAge uint, includeSubdomains, preload bool) mux.MiddlewareFunc {
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if preload {
+		value += "; preload"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(StrictTransportSecurity, value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
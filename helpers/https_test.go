@@ -0,0 +1,48 @@
+package helpers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirectMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("served"))
+	})
+
+	cases := []struct {
+		name     string
+		port     int
+		status   int
+		target   string
+		host     string
+		location string
+		code     int
+	}{
+		{"default port", 0, http.StatusMovedPermanently, "/a/b?c=d", "example.com:80", "https://example.com/a/b?c=d", 301},
+		{"custom port", 8443, http.StatusPermanentRedirect, "/a%2Fb", "example.com", "https://example.com:8443/a%2Fb", 308},
+		{"ipv6", 443, http.StatusMovedPermanently, "/", "[::1]:80", "https://[::1]/", 301},
+		{"acme", 0, http.StatusMovedPermanently, "/.well-known/acme-challenge/token", "example.com", "", 200},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler := HTTPSRedirectMiddleware(c.port, c.status, []string{"/.well-known/acme-challenge/"})(next)
+			req := httptest.NewRequest(http.MethodGet, c.target, nil)
+			req.Host = c.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, c.code, w.Code)
+			assert.Equal(t, c.location, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestHSTSMiddleware(t *testing.T) {
+	handler := HSTSMiddleware(31536000, true, true)(http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload", w.Header().Get(StrictTransportSecurity))
+}
@@ -0,0 +1,165 @@
+package helpers
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	AIMDLimit     = "aimd"
+	GradientLimit = "gradient"
+)
+
+var LimitAlgorithmNotSupportedError = errors.New("limit algorithm not supported")
+
+// LimitAlgorithm computes a new concurrency limit from an observed sample
+type LimitAlgorithm interface {
+	Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64
+}
+
+// AIMD increases the limit by one while requests succeed and the limiter is
+// well used, and backs off multiplicatively on drops or slow responses
+type AIMD struct {
+	BackoffRatio float64
+	Timeout      time.Duration
+}
+
+// NewAIMD create new AIMD limit algorithm
+func NewAIMD(timeout time.Duration) *AIMD {
+	return &AIMD{
+		BackoffRatio: 0.9,
+		Timeout:      timeout,
+	}
+}
+
+// Update implements LimitAlgorithm
+func (a *AIMD) Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	if dropped || (a.Timeout > 0 && rtt > a.Timeout) {
+		return limit * a.BackoffRatio
+	}
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// Gradient adjusts the limit by the ratio between the long term and the
+// short term latency, in the spirit of Netflix's Gradient2 limiter
+type Gradient struct {
+	sync.Mutex
+	Smoothing float64
+	Tolerance float64
+	longRTT   float64
+	shortRTT  float64
+	samples   int
+}
+
+// NewGradient create new Gradient limit algorithm
+func NewGradient() *Gradient {
+	return &Gradient{
+		Smoothing: 0.2,
+		Tolerance: 1.5,
+	}
+}
+
+// Update implements LimitAlgorithm
+func (g *Gradient) Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	g.Lock()
+	defer g.Unlock()
+
+	sample := float64(rtt)
+	if sample <= 0 {
+		return limit
+	}
+	if g.samples == 0 {
+		g.longRTT, g.shortRTT = sample, sample
+	}
+	g.samples++
+	// the long term average warms up quickly and then follows a window of ~600 samples
+	window := math.Min(float64(g.samples), 600)
+	g.longRTT += (sample - g.longRTT) / window
+	g.shortRTT += (sample - g.shortRTT) / math.Min(float64(g.samples), 10)
+
+	// the limiter is not saturated, there is nothing to learn
+	if !dropped && float64(inflight) < limit/2 {
+		return limit
+	}
+	// let the long term average drift down when latency is recovering
+	if g.longRTT/g.shortRTT > 2 {
+		g.longRTT *= 0.95
+	}
+
+	gradient := math.Max(0.5, math.Min(1.0, g.Tolerance*g.longRTT/g.shortRTT))
+	queue := math.Sqrt(limit)
+	newLimit := limit*gradient + queue
+	return limit*(1-g.Smoothing) + newLimit*g.Smoothing
+}
+
+// BuildLimitAlgorithm generates the LimitAlgorithm with the given name
+func BuildLimitAlgorithm(name string, timeout time.Duration) (LimitAlgorithm, error) {
+	switch name {
+	case AIMDLimit:
+		return NewAIMD(timeout), nil
+	case GradientLimit:
+		return NewGradient(), nil
+	}
+	return nil, LimitAlgorithmNotSupportedError
+}
+
+// AdaptiveLimiter bounds the number of in-flight requests with a limit
+// that is adjusted from the observed latency
+type AdaptiveLimiter struct {
+	sync.Mutex
+	algorithm LimitAlgorithm
+	limit     float64
+	minLimit  float64
+	maxLimit  float64
+	inflight  int
+}
+
+// NewAdaptiveLimiter create new AdaptiveLimiter starting at `initial`
+func NewAdaptiveLimiter(algorithm LimitAlgorithm, initial, min, max uint) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		algorithm: algorithm,
+		limit:     float64(initial),
+		minLimit:  float64(min),
+		maxLimit:  float64(max),
+	}
+}
+
+// Acquire reserves a slot, it returns false if the limit has been reached
+func (l *AdaptiveLimiter) Acquire() bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Release frees the slot and feeds the request latency to the algorithm
+func (l *AdaptiveLimiter) Release(rtt time.Duration, dropped bool) {
+	l.Lock()
+	defer l.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	limit := l.algorithm.Update(l.limit, rtt, inflight, dropped)
+	l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+}
+
+// Limit returns the current concurrency limit
+func (l *AdaptiveLimiter) Limit() uint {
+	l.Lock()
+	defer l.Unlock()
+	return uint(l.limit)
+}
+
+// Inflight returns the number of requests currently holding a slot
+func (l *AdaptiveLimiter) Inflight() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.inflight
+}
@@ -0,0 +1,100 @@
+package helpers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAIMD_Update(t *testing.T) {
+	cases := []struct {
+		name     string
+		limit    float64
+		rtt      time.Duration
+		inflight int
+		dropped  bool
+		expect   float64
+	}{
+		{"increase", 10, 10 * time.Millisecond, 5, false, 11},
+		{"idle", 10, 10 * time.Millisecond, 2, false, 10},
+		{"dropped", 10, 10 * time.Millisecond, 5, true, 9},
+		{"timeout", 10, 2 * time.Second, 5, false, 9},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := NewAIMD(time.Second)
+			assert.InDelta(t, c.expect, a.Update(c.limit, c.rtt, c.inflight, c.dropped), 0.001)
+		})
+	}
+}
+
+func TestGradient_Update(t *testing.T) {
+	g := NewGradient()
+	limit := 20.0
+	// steady latency lets the limit grow
+	for i := 0; i < 50; i++ {
+		limit = g.Update(limit, 10*time.Millisecond, int(limit), false)
+	}
+	assert.Greater(t, limit, 20.0)
+
+	// a latency spike shrinks the limit
+	grown := limit
+	for i := 0; i < 50; i++ {
+		limit = g.Update(limit, 200*time.Millisecond, int(limit), false)
+	}
+	assert.Less(t, limit, grown)
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := NewAdaptiveLimiter(NewAIMD(time.Second), 2, 1, 3)
+	assert.Equal(t, true, l.Acquire())
+	assert.Equal(t, true, l.Acquire())
+	assert.Equal(t, false, l.Acquire())
+	assert.Equal(t, 2, l.Inflight())
+
+	l.Release(time.Millisecond, false)
+	assert.Equal(t, uint(3), l.Limit())
+	l.Release(time.Millisecond, false)
+	// never grows beyond max_limit
+	assert.Equal(t, uint(3), l.Limit())
+
+	for i := 0; i < 20; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, true)
+	}
+	// never shrinks below min_limit
+	assert.Equal(t, uint(1), l.Limit())
+}
+
+func TestBuildLimitAlgorithm(t *testing.T) {
+	_, err := BuildLimitAlgorithm("unknown", 0)
+	assert.Equal(t, LimitAlgorithmNotSupportedError, err)
+	a, err := BuildLimitAlgorithm(AIMDLimit, 0)
+	assert.Nil(t, err)
+	assert.IsType(t, &AIMD{}, a)
+}
+
+func TestAdaptiveLimitMiddleware(t *testing.T) {
+	l := NewAdaptiveLimiter(NewAIMD(time.Second), 1, 1, 1)
+	// the rejected requests are written by the error pages of the location
+	writeError := func(w http.ResponseWriter, r *http.Request, status int) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("error page"))
+	}
+	handler := AdaptiveLimitMiddleware(l, writeError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	assert.True(t, l.Acquire())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "error page", w.Body.String())
+	assert.Equal(t, "1", w.Header().Get(XConcurrencyLimit))
+
+	l.Release(time.Millisecond, false)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -1,10 +1,21 @@
 package helpers
 
 import (
-	"github.com/gorilla/mux"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
+// XConcurrencyLimit reports the current adaptive limit of the location
+var XConcurrencyLimit = http.CanonicalHeaderKey("X-Concurrency-Limit")
+
+// ErrorWriter writes the error response of the status, such as the error
+// pages of the location
+type ErrorWriter func(w http.ResponseWriter, r *http.Request, status int)
+
 func MaxAllowedMiddleware(n uint) mux.MiddlewareFunc {
 	sem := make(chan struct{}, n)
 	
@@ -24,3 +35,76 @@ func MaxAllowedMiddleware(n uint) mux.MiddlewareFunc {
 		})
 	}
 }
+
+// AdaptiveLimitMiddleware rejects requests with 503, written by writeError,
+// once the in-flight requests reach the current limit of `l`
+func AdaptiveLimitMiddleware(l *AdaptiveLimiter, writeError ErrorWriter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.Acquire() {
+				w.Header().Set(XConcurrencyLimit, strconv.Itoa(int(l.Limit())))
+				writeError(w, r, http.StatusServiceUnavailable)
+				return
+			}
+			start := time.Now()
+			rec := NewResponseRecorder(w)
+			defer func() {
+				dropped := rec.Status == http.StatusBadGateway ||
+					rec.Status == http.StatusServiceUnavailable ||
+					rec.Status == http.StatusGatewayTimeout
+				l.Release(time.Since(start), dropped)
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// LimiterStatusHandler reports the current limit and in-flight requests
+// of each location as JSON
+func LimiterStatusHandler(limiters map[string]*AdaptiveLimiter) http.Handler {
+	type status struct {
+		Limit    uint `json:"limit"`
+		Inflight int  `json:"inflight"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := make(map[string]status, len(limiters))
+		for pattern, l := range limiters {
+			reply[pattern] = status{Limit: l.Limit(), Inflight: l.Inflight()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(reply)
+	})
+}
+
+// BodyLimitMiddleware rejects request bodies larger than `limit` bytes
+// with 413, whether the length is announced or not. The announced lengths
+// are rejected by writeError, the others by the proxy reading the body.
+func BodyLimitMiddleware(limit int64, writeError ErrorWriter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				writeError(w, r, http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DeadlineMiddleware replaces the read and write timeouts of the server for
+// the requests it handles, a zero timeout keeps the one of the server
+func DeadlineMiddleware(read, write time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			if read > 0 {
+				_ = rc.SetReadDeadline(time.Now().Add(read))
+			}
+			if write > 0 {
+				_ = rc.SetWriteDeadline(time.Now().Add(write))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
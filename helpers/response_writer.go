@@ -0,0 +1,59 @@
+package helpers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ResponseRecorder wraps a http.ResponseWriter and records the status code
+// and the number of bytes written to the client
+type ResponseRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int
+}
+
+// NewResponseRecorder create new ResponseRecorder
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{
+		ResponseWriter: w,
+		Status:         http.StatusOK,
+	}
+}
+
+// WriteHeader records the status code
+func (r *ResponseRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of bytes written
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher, it is required for streaming responses
+func (r *ResponseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, it is required for upgraded connections
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	r.Status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap returns the original http.ResponseWriter for http.ResponseController
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,86 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotateWriter is an io.Writer to a file that is rotated once it grows
+// beyond `maxSize` bytes, keeping at most `maxBackups` old files named
+// `<path>.1` (the newest) to `<path>.<maxBackups>`
+type RotateWriter struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotateWriter create new RotateWriter appending to the file at `path`
+func NewRotateWriter(path string, maxSize int64, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write writes `p` to the current file, rotating it first if needed
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotateWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if w.maxBackups > 0 {
+		// shift <path>.N-1 to <path>.N, the oldest one is overwritten
+		for i := w.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Close closes the current file
+func (w *RotateWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,126 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteMatch refers to the conditions of the requests routed to a location,
+// empty conditions match all the requests
+type RouteMatch struct {
+	// Hosts are host names, `*.example.com` matches any subdomain of example.com
+	Hosts   []string
+	Methods []string
+	// Headers and Query match the requests carrying each key with the value,
+	// or with any value for an empty one
+	Headers map[string]string
+	Query   map[string]string
+	// Path is matched according to PathMatch, exact, prefix at a segment
+	// boundary or regex, and as a gorilla mux path template if PathMatch is empty
+	Path      string
+	PathMatch string
+}
+
+// Route registers the handler on the router for the requests matching `m`,
+// the routes are tried in the order they are registered
+func (m *RouteMatch) Route(router *mux.Router, handler http.Handler) error {
+	route := router.NewRoute()
+	switch m.PathMatch {
+	case "":
+		route.Path(m.Path)
+	case "exact":
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return r.URL.Path == m.Path
+		})
+	case "prefix":
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return matchPrefix(r.URL.Path, m.Path)
+		})
+	case "regex":
+		re, err := regexp.Compile(m.Path)
+		if err != nil {
+			return err
+		}
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return re.MatchString(r.URL.Path)
+		})
+	default:
+		return fmt.Errorf("the path match \"%s\" not supported", m.PathMatch)
+	}
+
+	if len(m.Hosts) != 0 {
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			for _, host := range m.Hosts {
+				if MatchHost(r.Host, host) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if len(m.Methods) != 0 {
+		route.Methods(m.Methods...)
+	}
+	if len(m.Headers) != 0 {
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			for key, value := range m.Headers {
+				if !matchValues(r.Header.Values(key), value) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	if len(m.Query) != 0 {
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			query := r.URL.Query()
+			for key, value := range m.Query {
+				if !matchValues(query[key], value) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	route.Handler(handler)
+	return route.GetError()
+}
+
+// matchPrefix reports whether the path starts with the prefix at a segment
+// boundary, `/api` matches `/api` and `/api/items` but not `/apiary`
+func matchPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// matchValues reports whether one of the values is `value`, or whether
+// there is any value for an empty one
+func matchValues(values []string, value string) bool {
+	if len(value) == 0 {
+		return len(values) != 0
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHost reports whether the host of a request, with or without port,
+// matches the pattern, `*.example.com` matches any subdomain of example.com
+func MatchHost(host, pattern string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
+}
@@ -0,0 +1,78 @@
+package helpers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name))
+	})
+}
+
+func TestRouteMatch_Route(t *testing.T) {
+	router := mux.NewRouter()
+	// registered by priority, the first match wins
+	matches := []struct {
+		name  string
+		match RouteMatch
+	}{
+		{"regex", RouteMatch{Path: `^/v[0-9]+/users$`, PathMatch: "regex"}},
+		{"beta", RouteMatch{Path: "/", PathMatch: "prefix", Headers: map[string]string{"X-Beta": ""}}},
+		{"debug", RouteMatch{Path: "/", PathMatch: "prefix", Query: map[string]string{"debug": "1"}}},
+		{"api-write", RouteMatch{Path: "/api", PathMatch: "prefix", Hosts: []string{"*.example.com"}, Methods: []string{"POST", "PUT"}}},
+		{"api", RouteMatch{Path: "/api", PathMatch: "prefix", Hosts: []string{"*.example.com"}}},
+		{"exact", RouteMatch{Path: "/health", PathMatch: "exact"}},
+		{"template", RouteMatch{Path: "/items/{id:[0-9]+}"}},
+		{"default", RouteMatch{Path: "/", PathMatch: "prefix"}},
+	}
+	for _, m := range matches {
+		assert.Nil(t, m.match.Route(router, named(m.name)))
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		host   string
+		header string
+		route  string
+	}{
+		{"regex", "GET", "/v2/users", "example.com", "", "regex"},
+		{"header", "GET", "/v2/users/1", "example.com", "X-Beta", "beta"},
+		{"query", "GET", "/a?debug=1", "example.com", "", "debug"},
+		{"query value", "GET", "/a?debug=0", "example.com", "", "default"},
+		{"wildcard host and method", "POST", "/api/items", "api.example.com:8080", "", "api-write"},
+		{"wildcard host", "GET", "/api/items", "a.b.example.com", "", "api"},
+		{"apex is not a subdomain", "GET", "/api/items", "example.com", "", "default"},
+		{"prefix", "GET", "/api", "a.example.com", "", "api"},
+		{"prefix segment", "GET", "/apiary", "a.example.com", "", "default"},
+		{"exact", "GET", "/health", "example.com", "", "exact"},
+		{"exact only", "GET", "/health/x", "example.com", "", "default"},
+		{"template", "GET", "/items/12", "example.com", "", "template"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.target, nil)
+			req.Host = c.host
+			if len(c.header) != 0 {
+				req.Header.Set(c.header, "1")
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, c.route, w.Body.String())
+		})
+	}
+}
+
+func TestRouteMatch_InvalidPathMatch(t *testing.T) {
+	m := RouteMatch{Path: "/", PathMatch: "glob"}
+	assert.NotNil(t, m.Route(mux.NewRouter(), named("glob")))
+	m = RouteMatch{Path: "(", PathMatch: "regex"}
+	assert.NotNil(t, m.Route(mux.NewRouter(), named("regex")))
+}
@@ -0,0 +1,141 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"":        tls.NoClientCert,
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// ParseTLSVersion parses a version such as `1.2`, the empty version is 0
+func ParseTLSVersion(version string) (uint16, error) {
+	if len(version) == 0 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("the tls version \"%s\" not supported", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses the standard names of the cipher suites,
+// such as `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("the cipher suite \"%s\" not supported", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurves parses the names of the curves, X25519, P256, P384 and P521
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := tlsCurves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("the curve \"%s\" not supported", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// ParseClientAuth parses the client certificate policy, none, request or require
+func ParseClientAuth(auth string) (tls.ClientAuthType, error) {
+	a, ok := tlsClientAuth[auth]
+	if !ok {
+		return tls.NoClientCert, fmt.Errorf("the client auth \"%s\" not supported", auth)
+	}
+	return a, nil
+}
+
+// LoadCertPool reads a bundle of PEM certificates
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	in, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(in) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// NewClientTLSConfig builds the tls configuration to connect to a server,
+// `caFile` replaces the system roots, `certFile` and `keyFile` are the
+// client certificate, and `serverName` overrides the SNI and verified name
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if len(caFile) != 0 {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(certFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ClientCertMiddleware sets the `header` of the request to the subject of
+// the verified client certificate, a value sent by the client is dropped
+func ClientCertMiddleware(header string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del(header)
+			if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 && len(r.TLS.VerifiedChains[0]) != 0 {
+				r.Header.Set(header, r.TLS.VerifiedChains[0][0].Subject.String())
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	v, err := ParseTLSVersion("1.2")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+	_, err = ParseTLSVersion("2.0")
+	assert.NotNil(t, err)
+
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, suites)
+	_, err = ParseCipherSuites([]string{"TLS_UNKNOWN"})
+	assert.NotNil(t, err)
+
+	curves, err := ParseCurves([]string{"x25519", "P256"})
+	assert.Nil(t, err)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, curves)
+
+	auth, err := ParseClientAuth("require")
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, auth)
+}
+
+func TestClientCertMiddleware(t *testing.T) {
+	var subject string
+	handler := ClientCertMiddleware("X-Client-Subject")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = r.Header.Get("X-Client-Subject")
+	}))
+
+	// a spoofed header without a verified certificate is dropped
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Client-Subject", "CN=admin")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "", subject)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "client", Organization: []string{"acme"}}},
+	}}}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "CN=client,O=acme", subject)
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/gorilla/mux"
 	"go-balancer/config"
 	"go-balancer/helpers"
 	"go-balancer/proxy"
+	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"regexp"
+	"sort"
+	"time"
 )
 
+// configFile refers to the configuration read at start and on reload
+const configFile = "./config/config.yaml"
+
 func main() {
-	config, err := config.ReadConfig("./config/config.yaml")
+	config, err := config.ReadConfig(configFile)
 	if err != nil {
 		log.Fatalf("read config error: %s", err)
 	}
@@ -21,39 +30,357 @@ func main() {
 		log.Fatalf("verify config error: %s", err)
 	}
 
-	router := mux.NewRouter()
+	err = proxy.SetTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("trusted proxies error: %s", err)
+	}
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if config.Tracing != nil && config.Tracing.Enabled {
+		t := config.Tracing
+		shutdownTracing, err = proxy.InitTracing(t.Endpoint, t.Insecure, t.ServiceName, t.SampleRatio)
+		if err != nil {
+			log.Fatalf("init tracing error: %s", err)
+		}
+	}
+
+	// the locations are shared by all the listeners serving them
+	adaptive := config.AdaptiveLimit != nil && config.AdaptiveLimit.Enabled
+	limiters := make(map[string]*helpers.AdaptiveLimiter)
+	handlers := make(map[string]http.Handler)
+	proxies := make(map[string]*proxy.HTTPProxy)
+	tcpProxies := make(map[string]*proxy.TCPProxy)
+	udpProxies := make(map[string]*proxy.UDPProxy)
+	splits := make(map[string]*proxy.SplitProxy)
+	mirrors := make(map[string]*proxy.Mirror)
+	caches := make(map[string]*proxy.Cache)
+	layer4Schemas := make(map[string]map[string]bool)
+	for _, l := range config.Listeners {
+		if l.IsLayer4() {
+			if layer4Schemas[l.Locations[0]] == nil {
+				layer4Schemas[l.Locations[0]] = make(map[string]bool)
+			}
+			layer4Schemas[l.Locations[0]][l.Schema] = true
+		}
+	}
 	for _, l := range config.Location {
-		httpProxy, err := proxy.NewHTTPProxy(l.ProxyPass, l.BalanceMode)
+		opts := make([]proxy.Option, 0)
+		if l.SendProxyProtocol == "v1" {
+			opts = append(opts, proxy.WithProxyProtocol(1))
+		} else if l.SendProxyProtocol == "v2" {
+			opts = append(opts, proxy.WithProxyProtocol(2))
+		}
+		var upstreamTLS *tls.Config
+		if t := l.UpstreamTLS; t != nil {
+			upstreamTLS, err = helpers.NewClientTLSConfig(t.CA, t.Certificate, t.Key, t.ServerName, t.InsecureSkipVerify)
+			if err != nil {
+				log.Fatalf("upstream tls of location %s error: %s", l.Name, err)
+			}
+			opts = append(opts, proxy.WithUpstreamTLS(upstreamTLS))
+		}
+		if t := l.Transport; t != nil {
+			opts = append(opts, proxy.WithTransport(proxy.TransportConfig{
+				MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+				MaxConnsPerHost:       t.MaxConnsPerHost,
+				IdleConnTimeout:       time.Duration(t.IdleConnTimeout) * time.Second,
+				DialTimeout:           time.Duration(t.DialTimeout) * time.Second,
+				TLSHandshakeTimeout:   time.Duration(t.TLSHandshakeTimeout) * time.Second,
+				ResponseHeaderTimeout: time.Duration(t.ResponseHeaderTimeout) * time.Second,
+				KeepAlive:             time.Duration(t.KeepAlive) * time.Second,
+				DisableHTTP2:          t.DisableHTTP2,
+				DisableCompression:    t.DisableCompression,
+			}))
+		}
+		if u := l.Upgrade; u != nil {
+			opts = append(opts, proxy.WithUpgrade(proxy.UpgradeConfig{
+				BalanceMode:   u.BalanceMode,
+				IdleTimeout:   time.Duration(u.IdleTimeout) * time.Second,
+				KeepAlive:     time.Duration(u.KeepAlive) * time.Second,
+				CloseOnRemove: u.CloseOnRemove,
+				DrainTimeout:  time.Duration(u.DrainTimeout) * time.Second,
+			}))
+		}
+		if r := l.Rewrite; r != nil {
+			rules := make([]proxy.RewriteRule, 0, len(r.Rules))
+			for _, rule := range r.Rules {
+				rules = append(rules, proxy.RewriteRule{
+					Pattern:     regexp.MustCompile(rule.Regex),
+					Replacement: rule.Replacement,
+				})
+			}
+			opts = append(opts, proxy.WithRewrite(proxy.RewriteConfig{
+				StripPrefix: r.StripPrefix,
+				Rules:       rules,
+				AddPrefix:   r.AddPrefix,
+				Host:        r.Host,
+			}))
+		}
+		if l.RequestHeaders != nil || l.ResponseHeaders != nil || l.HideBackendHeaders {
+			headers := proxy.HeaderConfig{HideBackend: l.HideBackendHeaders}
+			if h := l.RequestHeaders; h != nil {
+				headers.Request = proxy.HeaderRules{Remove: h.Remove, Set: h.Set, Append: h.Append}
+			}
+			if h := l.ResponseHeaders; h != nil {
+				headers.Response = proxy.HeaderRules{Remove: h.Remove, Set: h.Set, Append: h.Append}
+			}
+			opts = append(opts, proxy.WithHeaders(headers))
+		}
+		// the limits of the location also reject the requests with its error pages
+		var pagesConfig proxy.ErrorPagesConfig
+		if e := l.ErrorPages; e != nil {
+			pages := make(map[int]proxy.ErrorPage, len(e.Pages))
+			for status, page := range e.Pages {
+				pages[status] = proxy.ErrorPage{File: page.File, Template: page.Template}
+			}
+			pagesConfig = proxy.ErrorPagesConfig{
+				Format: proxy.ErrorFormat(e.Format),
+				Pages:  pages,
+			}
+		}
+		errorPages, err := proxy.NewErrorPages(pagesConfig)
 		if err != nil {
-			log.Fatalf("create proxy error: %s", err)
+			log.Fatalf("error pages of location %s error: %s", l.Name, err)
+		}
+		opts = append(opts, proxy.WithErrorPages(errorPages))
+		if l.GRPC {
+			opts = append(opts, proxy.WithGRPC())
+		}
+		if l.GRPCHealthCheck {
+			opts = append(opts, proxy.WithGRPCHealthCheck(l.GRPCHealthService))
+		}
+		if t := l.TCP; t != nil {
+			opts = append(opts, proxy.WithTCP(proxy.TCPConfig{
+				IdleTimeout: time.Duration(t.IdleTimeout) * time.Second,
+			}))
+		}
+		if u := l.UDP; u != nil {
+			opts = append(opts, proxy.WithUDP(proxy.UDPConfig{
+				IdleTimeout: time.Duration(u.IdleTimeout) * time.Second,
+				MaxSessions: u.MaxSessions,
+			}))
+		}
+		// a location of tcp and udp listeners, such as dns, has a proxy for each
+		if schemas := layer4Schemas[l.Name]; schemas != nil {
+			if schemas["tcp"] {
+				tcpProxy, err := proxy.NewTCPProxy(l.ProxyPass, l.BalanceMode, opts...)
+				if err != nil {
+					log.Fatalf("create tcp proxy error: %s", err)
+				}
+				if config.HealthCheck {
+					tcpProxy.HealthCheck(config.HealthCheckInterval)
+				}
+				tcpProxies[l.Name] = tcpProxy
+			}
+			if schemas["udp"] {
+				udpProxy, err := proxy.NewUDPProxy(l.ProxyPass, l.BalanceMode, opts...)
+				if err != nil {
+					log.Fatalf("create udp proxy error: %s", err)
+				}
+				// udp backends rarely accept tcp connections, their check is opt-in
+				if config.HealthCheck && l.UDP != nil && l.UDP.HealthCheck {
+					udpProxy.HealthCheck(config.HealthCheckInterval)
+				}
+				udpProxies[l.Name] = udpProxy
+			}
+			continue
+		}
+		var handler http.Handler
+		if len(l.Groups) != 0 {
+			// each backend group is balanced by its own proxy
+			groups := make(map[string]*proxy.HTTPProxy)
+			order := make([]string, 0, len(l.Groups))
+			for _, g := range l.Groups {
+				httpProxy, err := proxy.NewHTTPProxy(g.ProxyPass, g.BalanceMode, opts...)
+				if err != nil {
+					log.Fatalf("create proxy of group %s error: %s", g.Name, err)
+				}
+				if config.HealthCheck {
+					httpProxy.HealthCheck(config.HealthCheckInterval)
+				}
+				groups[g.Name] = httpProxy
+				order = append(order, g.Name)
+				proxies[l.Name+"/"+g.Name] = httpProxy
+			}
+			splitProxy, err := proxy.NewSplitProxy(groups, order, splitConfig(l))
+			if err != nil {
+				log.Fatalf("create split proxy of location %s error: %s", l.Name, err)
+			}
+			splits[l.Name] = splitProxy
+			handler = splitProxy
+		} else {
+			httpProxy, err := proxy.NewHTTPProxy(l.ProxyPass, l.BalanceMode, opts...)
+			if err != nil {
+				log.Fatalf("create proxy error: %s", err)
+			}
+			// start health check
+			if config.HealthCheck {
+				httpProxy.HealthCheck(config.HealthCheckInterval)
+			}
+			proxies[l.Name] = httpProxy
+			handler = httpProxy
+		}
+		if m := l.Mirror; m != nil {
+			mirror, err := proxy.NewMirror(proxy.MirrorConfig{
+				Hosts:       m.ProxyPass,
+				BalanceMode: m.BalanceMode,
+				Percentage:  m.Percentage,
+				MaxBodySize: m.MaxBodySize,
+				Timeout:     time.Duration(m.Timeout) * time.Second,
+				MaxInflight: m.MaxInflight,
+				TLSConfig:   upstreamTLS,
+			}, opts...)
+			if err != nil {
+				log.Fatalf("create mirror of location %s error: %s", l.Name, err)
+			}
+			mirrors[l.Name] = mirror
+			handler = proxy.MirrorMiddleware(mirror)(handler)
+		}
+		if ca := l.Cache; ca != nil && ca.Enabled {
+			var store proxy.CacheStore = proxy.NewMemoryStore(ca.MaxBytes)
+			if ca.Store == "disk" {
+				store, err = proxy.NewDiskStore(ca.Path, ca.MaxBytes)
+				if err != nil {
+					log.Fatalf("create cache of location %s error: %s", l.Name, err)
+				}
+			}
+			// the response headers set with the variables of the request are not stored
+			var perRequest []string
+			if h := l.ResponseHeaders; h != nil {
+				rules := proxy.HeaderRules{Set: h.Set, Append: h.Append}
+				perRequest = rules.PerRequest()
+			}
+			cache := proxy.NewCache(store, ca.MaxObjectSize, perRequest...)
+			caches[l.Name] = cache
+			handler = proxy.CacheMiddleware(cache)(handler)
+		}
+		// compressed after the cache, which keeps the responses of the backends
+		if co := l.Compression; co != nil && co.Enabled {
+			handler = helpers.CompressMiddleware(helpers.CompressConfig{
+				Encodings: co.Encodings,
+				Types:     co.Types,
+				MinSize:   co.MinSize,
+			})(handler)
 		}
-		// start health check
-		if config.HealthCheck {
-			httpProxy.HealthCheck(config.HealthCheckInterval)
+		bodySize := config.ClientMaxBodySize
+		if l.ClientMaxBodySize > 0 {
+			bodySize = l.ClientMaxBodySize
 		}
-		router.Handle(l.Pattern, httpProxy)
+		if bodySize > 0 {
+			handler = helpers.BodyLimitMiddleware(int64(bodySize), errorPages.Write)(handler)
+		}
+		if l.ReadTimeout > 0 || l.WriteTimeout > 0 {
+			handler = helpers.DeadlineMiddleware(time.Duration(l.ReadTimeout)*time.Second,
+				time.Duration(l.WriteTimeout)*time.Second)(handler)
+		}
+		// each location learns its own concurrency limit
+		if adaptive {
+			al := config.AdaptiveLimit
+			algorithm, err := helpers.BuildLimitAlgorithm(al.Algorithm, time.Duration(al.Timeout)*time.Millisecond)
+			if err != nil {
+				log.Fatalf("create limiter error: %s", err)
+			}
+			limiter := helpers.NewAdaptiveLimiter(algorithm, al.InitialLimit, al.MinLimit, al.MaxLimit)
+			limiters[l.Name] = limiter
+			handler = helpers.AdaptiveLimitMiddleware(limiter, errorPages.Write)(handler)
+		}
+		handlers[l.Name] = handler
 	}
-	if config.MaxAllowed > 0 {
-		router.Use(helpers.MaxAllowedMiddleware(config.MaxAllowed))
+
+	var accessLogger *proxy.AccessLogger
+	if config.AccessLog != nil && config.AccessLog.Enabled {
+		var out io.Writer = os.Stdout
+		if config.AccessLog.Path != "stdout" {
+			out, err = helpers.NewRotateWriter(config.AccessLog.Path,
+				int64(config.AccessLog.MaxSize)<<20, int(config.AccessLog.MaxBackups))
+			if err != nil {
+				log.Fatalf("open access log error: %s", err)
+			}
+		}
+		accessLogger = proxy.NewAccessLogger(config.AccessLog.Format, out)
 	}
-	svr := http.Server{
-		Addr:    ":" + strconv.Itoa(config.Port),
-		Handler: router,
+	// a single semaphore bounds the requests of all the listeners
+	var maxAllowed mux.MiddlewareFunc
+	if config.MaxAllowed > 0 && !adaptive {
+		maxAllowed = helpers.MaxAllowedMiddleware(config.MaxAllowed)
 	}
 
-	// print config detail
-	config.Print()
+	// the routes are matched by priority, then in the order of the configuration
+	routes := append(config.Location[:0:0], config.Location...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority > routes[j].Priority
+	})
 
-	// listen and serve
-	if config.Schema == "http" {
-		err := svr.ListenAndServe()
-		if err != nil {
-			log.Fatalf("listen and serve error: %s", err)
+	servers := make([]*Server, 0, len(config.Listeners))
+	for _, l := range config.Listeners {
+		if l.Schema == "tcp" {
+			servers = append(servers, NewTCPServer(l, tcpProxies[l.Locations[0]]))
+			continue
+		}
+		if l.Schema == "udp" {
+			servers = append(servers, NewUDPServer(l, udpProxies[l.Locations[0]]))
+			continue
+		}
+		router := mux.NewRouter()
+		if adaptive && len(config.AdaptiveLimit.StatusPattern) != 0 {
+			router.Handle(config.AdaptiveLimit.StatusPattern, helpers.LimiterStatusHandler(limiters))
+		}
+		if len(config.PoolStatusPattern) != 0 {
+			router.Handle(config.PoolStatusPattern, proxy.AdminHandler(proxy.PoolStatsHandler(proxies)))
+		}
+		if len(config.MirrorStatusPattern) != 0 {
+			router.Handle(config.MirrorStatusPattern, proxy.AdminHandler(proxy.MirrorStatsHandler(mirrors)))
+		}
+		if len(config.CachePurgePattern) != 0 {
+			router.Handle(config.CachePurgePattern, proxy.AdminHandler(proxy.CachePurgeHandler(caches)))
 		}
-	} else if config.Schema == "https" {
-		err := svr.ListenAndServeTLS(config.SSLCertificate, config.SSLCertificateKey)
+		served := make(map[string]bool)
+		for _, name := range l.Locations {
+			served[name] = true
+		}
+		for _, location := range routes {
+			if !served[location.Name] {
+				continue
+			}
+			match := &helpers.RouteMatch{
+				Hosts:     location.Hosts,
+				Methods:   location.Methods,
+				Headers:   location.Headers,
+				Query:     location.Query,
+				Path:      location.Pattern,
+				PathMatch: location.PathMatch,
+			}
+			if err := match.Route(router, handlers[location.Name]); err != nil {
+				log.Fatalf("route location %s error: %s", location.Name, err)
+			}
+		}
+		if config.Tracing != nil && config.Tracing.Enabled {
+			router.Use(proxy.TracingMiddleware())
+		}
+		router.Use(proxy.RequestIDMiddleware())
+		if accessLogger != nil {
+			router.Use(proxy.AccessLogMiddleware(accessLogger))
+		}
+		if maxAllowed != nil {
+			router.Use(maxAllowed)
+		}
+		server, err := NewServer(config, l, router)
 		if err != nil {
-			log.Fatalf("listen and serve error: %s", err)
+			log.Fatalf("create listener %s error: %s", l.Name, err)
 		}
+		servers = append(servers, server)
+	}
+
+	// print config detail
+	config.Print()
+
+	// the traffic split of the locations is adjusted on SIGHUP
+	watchReload(configFile, splits)
+
+	// listen and serve until a listener fails or the balancer is stopped
+	err = Serve(servers)
+	// flush the spans that are not exported yet
+	_ = shutdownTracing(context.Background())
+	if err != nil {
+		log.Fatalf("listen and serve error: %s", err)
 	}
 }
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-balancer/helpers"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	JSONLogFormat     = "json"
+	CombinedLogFormat = "combined"
+)
+
+// AccessRecord is a single line of the access log, Retries is always 0 as
+// the proxy does not retry yet
+type AccessRecord struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id"`
+	ClientIP        string    `json:"client_ip"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Proto           string    `json:"proto"`
+	Status          int       `json:"status"`
+	Bytes           int       `json:"bytes"`
+	Duration        float64   `json:"duration"`
+	Backend         string    `json:"backend"`
+	Group           string    `json:"group,omitempty"`
+	Cache           string    `json:"cache,omitempty"`
+	Mode            string    `json:"balance_mode"`
+	Retries         int       `json:"retries"`
+	UpstreamLatency float64   `json:"upstream_latency"`
+	Referer         string    `json:"referer"`
+	UserAgent       string    `json:"user_agent"`
+}
+
+// AccessLogger writes one record per request to `out`
+type AccessLogger struct {
+	sync.Mutex
+	format string
+	out    io.Writer
+}
+
+// NewAccessLogger create new AccessLogger with the json or combined format
+func NewAccessLogger(format string, out io.Writer) *AccessLogger {
+	return &AccessLogger{
+		format: format,
+		out:    out,
+	}
+}
+
+// Log writes the record in the format of the logger
+func (a *AccessLogger) Log(record *AccessRecord) {
+	var line []byte
+	if a.format == JSONLogFormat {
+		line, _ = json.Marshal(record)
+		line = append(line, '\n')
+	} else {
+		line = []byte(combinedLine(record))
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	_, _ = a.out.Write(line)
+}
+
+// combinedLine formats the record in the combined log format, followed by
+// the backend, balance mode, retries, upstream latency, duration and request ID
+func combinedLine(r *AccessRecord) string {
+	backend := r.Backend
+	if len(backend) == 0 {
+		backend = "-"
+	}
+	mode := r.Mode
+	if len(mode) == 0 {
+		mode = "-"
+	}
+	requestID := r.RequestID
+	if len(requestID) == 0 {
+		requestID = "-"
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %q %q %s %s %d %.3f %.3f %s\n",
+		r.ClientIP, r.Time.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.Path, r.Proto,
+		r.Status, r.Bytes, r.Referer, r.UserAgent, backend, mode, r.Retries, r.UpstreamLatency, r.Duration, requestID)
+}
+
+// AccessLogMiddleware logs every request handled by the router
+func AccessLogMiddleware(a *AccessLogger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r, info := WithRequestInfo(r)
+			rec := helpers.NewResponseRecorder(w)
+			next.ServeHTTP(rec, r)
+
+			a.Log(&AccessRecord{
+				Time:            start,
+				RequestID:       info.ID,
+				ClientIP:        GetIP(r),
+				Method:          r.Method,
+				Path:            r.URL.RequestURI(),
+				Proto:           r.Proto,
+				Status:          rec.Status,
+				Bytes:           rec.Bytes,
+				Duration:        time.Since(start).Seconds(),
+				Backend:         info.Backend,
+				Group:           info.Group,
+				Cache:           info.Cache,
+				Mode:            info.Mode,
+				Retries:         info.Retries,
+				UpstreamLatency: info.UpstreamLatency.Seconds(),
+				Referer:         r.Referer(),
+				UserAgent:       r.UserAgent(),
+			})
+		})
+	}
+}
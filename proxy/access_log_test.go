@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+	u, _ := url.Parse(backend.URL)
+
+	cases := []struct {
+		name   string
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{
+			"json",
+			JSONLogFormat,
+			func(t *testing.T, line string) {
+				var record AccessRecord
+				assert.Nil(t, json.Unmarshal([]byte(line), &record))
+				assert.Equal(t, "10.0.0.1", record.ClientIP)
+				assert.Equal(t, "/path?q=1", record.Path)
+				assert.Equal(t, http.StatusCreated, record.Status)
+				assert.Equal(t, 5, record.Bytes)
+				assert.Equal(t, u.Host, record.Backend)
+				assert.Equal(t, "round-robin", record.Mode)
+				assert.Greater(t, record.UpstreamLatency, 0.0)
+			},
+		},
+		{
+			"combined",
+			CombinedLogFormat,
+			func(t *testing.T, line string) {
+				assert.True(t, strings.HasPrefix(line, "10.0.0.1 - - ["))
+				assert.Contains(t, line, "\"GET /path?q=1 HTTP/1.1\" 201 5 ")
+				assert.Contains(t, line, u.Host+" round-robin 0 ")
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			handler := AccessLogMiddleware(NewAccessLogger(c.format, out))(httpProxy)
+			req := httptest.NewRequest(http.MethodGet, "/path?q=1", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			c.check(t, out.String())
+		})
+	}
+}
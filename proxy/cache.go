@@ -0,0 +1,568 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// XCache reports how the cache served the response, HIT, MISS, STALE,
+// REVALIDATED or BYPASS
+var XCache = http.CanonicalHeaderKey("X-Cache")
+
+// CacheRevalidateTimeout bounds the background revalidation of a stale response
+var CacheRevalidateTimeout = 30 * time.Second
+
+// cacheableStatus are the statuses of the responses that may be stored
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// Cache stores the responses of a location according to their
+// `Cache-Control`, `Expires` and `Vary` headers, and revalidates them with
+// `ETag` and `Last-Modified`. Concurrent misses of a resource are coalesced
+// into a single upstream request.
+type Cache struct {
+	store         CacheStore
+	maxObjectSize int64
+	// perRequest are the headers not stored, their values differ between
+	// the responses of a resource
+	perRequest []string
+
+	mu    sync.Mutex
+	calls map[string]chan struct{}
+}
+
+// NewCache create new Cache on the store, responses larger than
+// `maxObjectSize` bytes are not stored, 0 keeps 1MB. The `perRequest`
+// headers, such as the response headers set with the variables of the
+// request, are not stored, nor is X-Request-ID.
+func NewCache(store CacheStore, maxObjectSize int64, perRequest ...string) *Cache {
+	if maxObjectSize <= 0 {
+		maxObjectSize = 1 << 20
+	}
+	return &Cache{
+		store:         store,
+		maxObjectSize: maxObjectSize,
+		perRequest:    append([]string{XRequestID}, perRequest...),
+		calls:         make(map[string]chan struct{}),
+	}
+}
+
+// Purge removes the resource of the key, formatted as `scheme://host/path?query`,
+// the resources under the key for a prefix, or all of them for an empty key.
+// A key without scheme removes the resource of both http and https.
+func (c *Cache) Purge(key string, prefix bool) int {
+	if len(key) == 0 || strings.Contains(key, "://") {
+		return purgeKeys(c.store, key, prefix)
+	}
+	return purgeKeys(c.store, "http://"+key, prefix) + purgeKeys(c.store, "https://"+key, prefix)
+}
+
+// cacheKey identifies the resource of the request, the responses of http and
+// https are kept apart
+func cacheKey(r *http.Request) string {
+	return GetProto(r) + "://" + strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// parseCacheControl returns the directives of the Cache-Control headers
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if len(name) != 0 {
+				directives[strings.ToLower(name)] = strings.Trim(arg, "\"")
+			}
+		}
+	}
+	return directives
+}
+
+// seconds parses the duration of a directive, it reports false when absent or invalid
+func seconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// newCachedResponse returns the response to store, or nil when it cannot be stored
+func newCachedResponse(r *http.Request, status int, header http.Header, body []byte, received time.Time) *CachedResponse {
+	if !cacheableStatus[status] || len(header.Values("Set-Cookie")) != 0 {
+		return nil
+	}
+	cc := parseCacheControl(header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+
+	resp := &CachedResponse{
+		Status: status,
+		Header: header.Clone(),
+		Body:   body,
+		Vary:   make(map[string]string),
+		Stored: received,
+	}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if len(name) != 0 {
+				resp.Vary[http.CanonicalHeaderKey(name)] = strings.Join(r.Header.Values(name), ", ")
+			}
+		}
+	}
+
+	explicit := true
+	if lifetime, ok := seconds(cc, "s-maxage"); ok {
+		resp.Lifetime = lifetime
+	} else if lifetime, ok := seconds(cc, "max-age"); ok {
+		resp.Lifetime = lifetime
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = received
+		}
+		resp.Lifetime = max(expires.Sub(date), 0)
+	} else if len(header.Get("Expires")) != 0 {
+		// an invalid date refers to the past
+		resp.Lifetime = 0
+	} else {
+		explicit = false
+	}
+	hasValidator := len(header.Get("ETag")) != 0 || len(header.Get("Last-Modified")) != 0
+	if !explicit && !hasValidator {
+		return nil
+	}
+	if _, ok := cc["no-cache"]; ok {
+		resp.Lifetime = 0
+	}
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		resp.Age = time.Duration(age) * time.Second
+	}
+	resp.Header.Del("Age")
+	resp.Header.Del(XCache)
+	resp.StaleWhileRevalidate, _ = seconds(cc, "stale-while-revalidate")
+	resp.StaleIfError, _ = seconds(cc, "stale-if-error")
+	_, resp.MustRevalidate = cc["must-revalidate"]
+	if _, ok := cc["proxy-revalidate"]; ok {
+		resp.MustRevalidate = true
+	}
+	return resp
+}
+
+func (resp *CachedResponse) age(now time.Time) time.Duration {
+	return resp.Age + now.Sub(resp.Stored)
+}
+
+func (resp *CachedResponse) fresh(now time.Time) bool {
+	return resp.age(now) < resp.Lifetime
+}
+
+// staleWithin reports whether the response is stale for less than `window`
+func (resp *CachedResponse) staleWithin(now time.Time, window time.Duration) bool {
+	return !resp.MustRevalidate && resp.age(now) < resp.Lifetime+window
+}
+
+// matches reports whether the request selects the variant
+func (resp *CachedResponse) matches(r *http.Request) bool {
+	for name, value := range resp.Vary {
+		if strings.Join(r.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sameVary reports whether both variants depend on the same request headers
+func (resp *CachedResponse) sameVary(other *CachedResponse) bool {
+	if len(resp.Vary) != len(other.Vary) {
+		return false
+	}
+	for name := range resp.Vary {
+		if _, ok := other.Vary[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the variant of the resource selected by the request
+func (c *Cache) lookup(key string, r *http.Request) *CachedResponse {
+	entry, ok := c.store.Get(key)
+	if !ok {
+		return nil
+	}
+	for _, v := range entry.Variants {
+		if v.matches(r) {
+			return v
+		}
+	}
+	return nil
+}
+
+// save stores the variant, replacing the variant of the same request headers
+// and the variants depending on other request headers
+func (c *Cache) save(key string, r *http.Request, resp *CachedResponse) {
+	for _, name := range c.perRequest {
+		resp.Header.Del(name)
+	}
+	variants := []*CachedResponse{resp}
+	if entry, ok := c.store.Get(key); ok {
+		for _, v := range entry.Variants {
+			if v.sameVary(resp) && !v.matches(r) {
+				variants = append(variants, v)
+			}
+		}
+	}
+	c.store.Set(key, &CacheEntry{Variants: variants})
+}
+
+// acquire returns whether the caller fetches the resource, or the channel
+// closed once the caller fetching it is done
+func (c *Cache) acquire(key string) (chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.calls[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	c.calls[key] = done
+	return done, true
+}
+
+func (c *Cache) release(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// CacheMiddleware serves the requests of a location from the cache
+func CacheMiddleware(c *Cache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.serve(w, r, next)
+		})
+	}
+}
+
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := cacheKey(r)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		next.ServeHTTP(w, r)
+		// the unsafe methods invalidate the stored resource
+		if r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+			c.store.Delete(key)
+		}
+		return
+	}
+	cc := parseCacheControl(r.Header)
+	_, noStore := cc["no-store"]
+	if noStore || len(r.Header.Get("Authorization")) != 0 || len(r.Header.Get("Range")) != 0 || IsUpgrade(r) || IsGRPC(r) {
+		setCacheStatus(w, r, "BYPASS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	for {
+		now := time.Now()
+		cached := c.lookup(key, r)
+		if cached != nil {
+			_, noCache := cc["no-cache"]
+			if maxAge, ok := seconds(cc, "max-age"); ok && cached.age(now) > maxAge {
+				noCache = true
+			}
+			if !noCache && cached.fresh(now) {
+				c.write(w, r, cached, "HIT")
+				return
+			}
+			if !noCache && cached.staleWithin(now, cached.StaleWhileRevalidate) {
+				c.write(w, r, cached, "STALE")
+				c.revalidate(key, r, cached, next)
+				return
+			}
+		}
+		if r.Method == http.MethodHead {
+			// a response to HEAD has no body to store
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		done, leader := c.acquire(key)
+		if !leader {
+			// the response of the concurrent request is likely stored by then
+			select {
+			case <-done:
+				if cached := c.lookup(key, r); cached != nil && cached.fresh(time.Now()) {
+					continue
+				}
+				c.fetch(w, r, next, key, cached)
+			case <-r.Context().Done():
+			}
+			return
+		}
+		// the proxy panics with http.ErrAbortHandler when the client is gone
+		defer c.release(key, done)
+		c.fetch(w, r, next, key, cached)
+		return
+	}
+}
+
+// revalidate refreshes the stale response in the background, once at a time
+func (c *Cache) revalidate(key string, r *http.Request, cached *CachedResponse, next http.Handler) {
+	done, leader := c.acquire(key)
+	if !leader {
+		return
+	}
+	// the revalidation outlives the request of the client, a stalled backend
+	// releases the resource after CacheRevalidateTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), CacheRevalidateTimeout)
+	req := r.Clone(ctx)
+	go func() {
+		defer cancel()
+		defer c.release(key, done)
+		c.fetch(nil, req, next, key, cached)
+	}()
+}
+
+// fetch requests the resource, conditionally when a response is cached, and
+// stores the response. The response is written to `w` unless it is nil.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, key string, cached *CachedResponse) {
+	req := r
+	if cached != nil {
+		req = r.Clone(r.Context())
+		if etag := cached.Header.Get("ETag"); len(etag) != 0 {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := cached.Header.Get("Last-Modified"); len(modified) != 0 {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	cw := &cacheWriter{
+		client: w,
+		header: make(http.Header),
+		limit:  c.maxObjectSize,
+		forward: func(status int) bool {
+			if w == nil {
+				return false
+			}
+			if cached != nil && (status == http.StatusNotModified ||
+				status >= 500 && cached.staleWithin(time.Now(), cached.StaleIfError)) {
+				return false
+			}
+			return true
+		},
+	}
+	if w != nil {
+		setCacheStatus(w, r, "MISS")
+	}
+	next.ServeHTTP(cw, req)
+	cw.finish()
+	now := time.Now()
+
+	switch {
+	case cached != nil && cw.status == http.StatusNotModified:
+		header := cached.Header.Clone()
+		for name, values := range cw.header {
+			header[name] = values
+		}
+		refreshed := newCachedResponse(r, cached.Status, header, cached.Body, now)
+		if refreshed != nil {
+			c.save(key, r, refreshed)
+		} else {
+			c.store.Delete(key)
+			refreshed = cached
+		}
+		if w != nil {
+			c.write(w, r, refreshed, "REVALIDATED")
+		}
+	case cached != nil && !cw.forwarded && cw.status >= 500:
+		if w != nil {
+			c.write(w, r, cached, "STALE")
+		}
+	case !cw.overflow && !cw.aborted:
+		if resp := newCachedResponse(r, cw.status, cw.header, cw.body.Bytes(), now); resp != nil {
+			c.save(key, r, resp)
+		}
+	}
+}
+
+// write serves the cached response, or 304 to a matching conditional request.
+// The headers already set for the request, such as X-Request-ID, are kept.
+func (c *Cache) write(w http.ResponseWriter, r *http.Request, resp *CachedResponse, status string) {
+	header := w.Header()
+	for name, values := range resp.Header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+	header.Set("Age", strconv.Itoa(int(resp.age(time.Now()).Seconds())))
+	setCacheStatus(w, r, status)
+
+	if notModified(r, resp.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.WriteHeader(resp.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(resp.Body)
+	}
+}
+
+// notModified reports whether the conditional request matches the validators of the response
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); len(inm) != 0 {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || (len(etag) != 0 && candidate == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+func setCacheStatus(w http.ResponseWriter, r *http.Request, status string) {
+	w.Header().Set(XCache, status)
+	if info := GetRequestInfo(r.Context()); info != nil {
+		info.Cache = status
+	}
+}
+
+// cacheWriter buffers the response to store it, and forwards it to the
+// client unless the cached response is served instead
+type cacheWriter struct {
+	client  http.ResponseWriter
+	header  http.Header
+	forward func(status int) bool
+
+	status    int
+	forwarded bool
+	body      bytes.Buffer
+	limit     int64
+	overflow  bool
+	aborted   bool
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if status >= 100 && status < 200 {
+		// informational responses are forwarded as is
+		if cw.client != nil && cw.forward(http.StatusOK) {
+			for name, values := range cw.header {
+				cw.client.Header()[name] = values
+			}
+			cw.client.WriteHeader(status)
+		}
+		return
+	}
+	cw.status = status
+	cw.forwarded = cw.forward(status)
+	if cw.forwarded {
+		header := cw.client.Header()
+		for name, values := range cw.header {
+			header[name] = values
+		}
+		cw.client.WriteHeader(status)
+	}
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.overflow = true
+			cw.body.Reset()
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	if cw.forwarded {
+		n, err := cw.client.Write(b)
+		if err != nil {
+			cw.aborted = true
+		}
+		return n, err
+	}
+	return len(b), nil
+}
+
+func (cw *cacheWriter) Flush() {
+	if cw.forwarded {
+		if f, ok := cw.client.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// finish completes a response without body
+func (cw *cacheWriter) finish() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+}
+
+// CachePurgeHandler removes cached resources of all the locations, with DELETE
+// or PURGE and the query `key`, formatted as `host/path?query` with an optional
+// scheme, and `prefix=true` to remove the resources under the key. Without key all the resources are removed.
+func CachePurgeHandler(caches map[string]*Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete && r.Method != "PURGE" {
+			w.Header().Set("Allow", "DELETE, PURGE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		key := r.URL.Query().Get("key")
+		prefix, _ := strconv.ParseBool(r.URL.Query().Get("prefix"))
+		purged := 0
+		for _, c := range caches {
+			purged += c.Purge(key, prefix)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	})
+}
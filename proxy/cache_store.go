@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response stored by the cache
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// Vary holds the values of the request headers named by the Vary header of the response
+	Vary map[string]string
+	// Stored is the time the response was received, Age its age at that time
+	Stored   time.Time
+	Age      time.Duration
+	Lifetime time.Duration
+	// StaleWhileRevalidate and StaleIfError extend the use of the stale response
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	MustRevalidate       bool
+}
+
+// CacheEntry holds the variants of a resource
+type CacheEntry struct {
+	Variants []*CachedResponse
+}
+
+// size approximates the bytes of the entry
+func (e *CacheEntry) size() int64 {
+	var n int64
+	for _, v := range e.Variants {
+		n += int64(len(v.Body))
+		for key, values := range v.Header {
+			n += int64(len(key))
+			for _, value := range values {
+				n += int64(len(value))
+			}
+		}
+	}
+	return n
+}
+
+// CacheStore keeps the cached resources by key, the entries are not modified once stored
+type CacheStore interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string) bool
+	Keys() []string
+}
+
+// lruIndex evicts the least recently used items once their size exceeds maxBytes
+type lruIndex struct {
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	evict    func(key string, value interface{})
+}
+
+type lruItem struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+func newLRUIndex(maxBytes int64, evict func(key string, value interface{})) *lruIndex {
+	return &lruIndex{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		evict:    evict,
+	}
+}
+
+func (l *lruIndex) get(key string) (interface{}, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+// set adds the item, an item larger than maxBytes is not added
+func (l *lruIndex) set(key string, value interface{}, size int64) bool {
+	l.remove(key, false)
+	if size > l.maxBytes {
+		return false
+	}
+	l.items[key] = l.ll.PushFront(&lruItem{key: key, value: value, size: size})
+	l.size += size
+	for l.size > l.maxBytes {
+		l.remove(l.ll.Back().Value.(*lruItem).key, true)
+	}
+	return true
+}
+
+// remove deletes the item, `evict` is called for evicted items only
+func (l *lruIndex) remove(key string, evicted bool) bool {
+	e, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	item := e.Value.(*lruItem)
+	l.ll.Remove(e)
+	delete(l.items, key)
+	l.size -= item.size
+	if evicted && l.evict != nil {
+		l.evict(item.key, item.value)
+	}
+	return true
+}
+
+func (l *lruIndex) keys() []string {
+	keys := make([]string, 0, len(l.items))
+	for key := range l.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// MemoryStore keeps the cached resources in memory, bounded by bytes
+type MemoryStore struct {
+	sync.Mutex
+	index *lruIndex
+}
+
+// NewMemoryStore create new MemoryStore of `maxBytes`
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{index: newLRUIndex(maxBytes, nil)}
+}
+
+// Get returns the entry of the key
+func (s *MemoryStore) Get(key string) (*CacheEntry, bool) {
+	s.Lock()
+	defer s.Unlock()
+	value, ok := s.index.get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*CacheEntry), true
+}
+
+// Set stores the entry of the key, evicting the least recently used entries
+func (s *MemoryStore) Set(key string, entry *CacheEntry) {
+	s.Lock()
+	defer s.Unlock()
+	s.index.set(key, entry, entry.size()+int64(len(key)))
+}
+
+// Delete removes the entry of the key
+func (s *MemoryStore) Delete(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.index.remove(key, false)
+}
+
+// Keys returns the keys of the entries
+func (s *MemoryStore) Keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	return s.index.keys()
+}
+
+// DiskStore keeps the cached resources in files of a directory, bounded by
+// bytes, the index of the files is kept in memory
+type DiskStore struct {
+	sync.Mutex
+	dir   string
+	index *lruIndex
+}
+
+const cacheFileSuffix = ".cache"
+
+// NewDiskStore create new DiskStore of `maxBytes` in the directory, the
+// files of a previous run are removed
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range stale {
+		_ = os.Remove(file)
+	}
+	return &DiskStore{
+		dir: dir,
+		index: newLRUIndex(maxBytes, func(_ string, file interface{}) {
+			_ = os.Remove(file.(string))
+		}),
+	}, nil
+}
+
+func (s *DiskStore) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+cacheFileSuffix)
+}
+
+// Get reads the entry of the key
+func (s *DiskStore) Get(key string) (*CacheEntry, bool) {
+	s.Lock()
+	file, ok := s.index.get(key)
+	s.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(file.(string))
+	if err != nil {
+		return nil, false
+	}
+	var entry CacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Set writes the entry of the key, evicting the least recently used entries
+func (s *DiskStore) Set(key string, entry *CacheEntry) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(entry); err != nil {
+		return
+	}
+	file := s.file(key)
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data.Bytes())
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err != nil || os.Rename(tmp.Name(), file) != nil {
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	if !s.index.set(key, file, int64(data.Len())) {
+		_ = os.Remove(file)
+	}
+}
+
+// Delete removes the entry of the key
+func (s *DiskStore) Delete(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.index.remove(key, false) {
+		return false
+	}
+	_ = os.Remove(s.file(key))
+	return true
+}
+
+// Keys returns the keys of the entries
+func (s *DiskStore) Keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	return s.index.keys()
+}
+
+// purgeKeys removes the entry of the key, the entries under the key for a
+// prefix, or all of them for an empty key
+func purgeKeys(store CacheStore, key string, prefix bool) int {
+	n := 0
+	if len(key) != 0 && !prefix {
+		if store.Delete(key) {
+			n++
+		}
+		return n
+	}
+	for _, k := range store.Keys() {
+		if strings.HasPrefix(k, key) && store.Delete(k) {
+			n++
+		}
+	}
+	return n
+}
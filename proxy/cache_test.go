@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type cacheRequest struct {
+	method string
+	header map[string]string
+	status int
+	xCache string
+	body   string
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   map[string]string
+		requests []cacheRequest
+		hits     int64
+	}{
+		{
+			name:   "max-age",
+			header: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodGet, nil, http.StatusOK, "HIT", "1 "},
+				{http.MethodHead, nil, http.StatusOK, "HIT", ""},
+			},
+			hits: 1,
+		},
+		{
+			name:   "expires",
+			header: map[string]string{"Expires": time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodGet, nil, http.StatusOK, "HIT", "1 "},
+			},
+			hits: 1,
+		},
+		{
+			name:   "no-store",
+			header: map[string]string{"Cache-Control": "no-store"},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodGet, nil, http.StatusOK, "MISS", "2 "},
+			},
+			hits: 2,
+		},
+		{
+			name:   "private",
+			header: map[string]string{"Cache-Control": "private, max-age=60"},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodGet, nil, http.StatusOK, "MISS", "2 "},
+			},
+			hits: 2,
+		},
+		{
+			name:   "set cookie",
+			header: map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=b"},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodGet, nil, http.StatusOK, "MISS", "2 "},
+			},
+			hits: 2,
+		},
+		{
+			name:   "vary",
+			header: map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"},
+			requests: []cacheRequest{
+				{http.MethodGet, map[string]string{"Accept-Language": "en"}, http.StatusOK, "MISS", "1 en"},
+				{http.MethodGet, map[string]string{"Accept-Language": "fr"}, http.StatusOK, "MISS", "2 fr"},
+				{http.MethodGet, map[string]string{"Accept-Language": "en"}, http.StatusOK, "HIT", "1 en"},
+				{http.MethodGet, map[string]string{"Accept-Language": "fr"}, http.StatusOK, "HIT", "2 fr"},
+			},
+			hits: 2,
+		},
+		{
+			name:   "bypass",
+			header: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []cacheRequest{
+				{http.MethodGet, map[string]string{"Authorization": "Basic YTpi"}, http.StatusOK, "BYPASS", "1 "},
+				{http.MethodGet, map[string]string{"Cache-Control": "no-store"}, http.StatusOK, "BYPASS", "2 "},
+				{http.MethodGet, nil, http.StatusOK, "MISS", "3 "},
+				{http.MethodGet, map[string]string{"Cache-Control": "no-cache"}, http.StatusOK, "MISS", "4 "},
+			},
+			hits: 4,
+		},
+		{
+			name:   "unsafe method invalidates",
+			header: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodPost, nil, http.StatusOK, "", "2 "},
+				{http.MethodGet, nil, http.StatusOK, "MISS", "3 "},
+			},
+			hits: 3,
+		},
+		{
+			name:   "conditional request",
+			header: map[string]string{"Cache-Control": "max-age=60", "ETag": `"v1"`},
+			requests: []cacheRequest{
+				{http.MethodGet, nil, http.StatusOK, "MISS", "1 "},
+				{http.MethodGet, map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified, "HIT", ""},
+				{http.MethodGet, map[string]string{"If-None-Match": `"v0"`}, http.StatusOK, "HIT", "1 "},
+			},
+			hits: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var hits int64
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt64(&hits, 1)
+				for key, value := range c.header {
+					w.Header().Set(key, value)
+				}
+				_, _ = w.Write([]byte(strconv.FormatInt(n, 10) + " " + r.Header.Get("Accept-Language")))
+			})
+			handler := CacheMiddleware(NewCache(NewMemoryStore(1<<20), 0))(backend)
+
+			for _, req := range c.requests {
+				r := httptest.NewRequest(req.method, "http://example.com/a?b=c", nil)
+				for key, value := range req.header {
+					r.Header.Set(key, value)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				assert.Equal(t, req.status, w.Code)
+				assert.Equal(t, req.xCache, w.Header().Get(XCache))
+				assert.Equal(t, req.body, w.Body.String())
+			}
+			assert.Equal(t, c.hits, atomic.LoadInt64(&hits))
+		})
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	cases := []struct {
+		name    string
+		control string
+		// status of the backend once the response is stale
+		status int
+		xCache string
+		body   string
+	}{
+		{"not modified", "max-age=0", http.StatusNotModified, "REVALIDATED", "first"},
+		{"modified", "max-age=0", http.StatusOK, "MISS", "second"},
+		{"stale if error", "max-age=0, stale-if-error=60", http.StatusBadGateway, "STALE", "first"},
+		{"error", "max-age=0", http.StatusBadGateway, "MISS", "second"},
+		{"must revalidate", "max-age=0, stale-if-error=60, must-revalidate", http.StatusBadGateway, "MISS", "second"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var hits int64
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", c.control)
+				w.Header().Set("ETag", `"v1"`)
+				if atomic.AddInt64(&hits, 1) == 1 {
+					_, _ = w.Write([]byte("first"))
+					return
+				}
+				assert.Equal(t, `"v1"`, r.Header.Get("If-None-Match"))
+				w.WriteHeader(c.status)
+				if c.status != http.StatusNotModified {
+					_, _ = w.Write([]byte("second"))
+				}
+			})
+			handler := CacheMiddleware(NewCache(NewMemoryStore(1<<20), 0))(backend)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+			assert.Equal(t, "first", w.Body.String())
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+			assert.Equal(t, c.xCache, w.Header().Get(XCache))
+			assert.Equal(t, c.body, w.Body.String())
+			assert.Equal(t, int64(2), atomic.LoadInt64(&hits))
+		})
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var hits int64
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = w.Write([]byte(strconv.FormatInt(n, 10)))
+	})
+	handler := CacheMiddleware(NewCache(NewMemoryStore(1<<20), 0))(backend)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.Equal(t, "MISS", w.Header().Get(XCache))
+
+	// the stale response is served while it is refreshed in the background
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.Equal(t, "STALE", w.Header().Get(XCache))
+	assert.Equal(t, "1", w.Body.String())
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+		return w.Body.String() == "2"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheRevalidateTimeout(t *testing.T) {
+	timeout := CacheRevalidateTimeout
+	CacheRevalidateTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { CacheRevalidateTimeout = timeout })
+
+	var hits int64
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) > 1 {
+			// the backend stalls the revalidation
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = w.Write([]byte("hello"))
+	})
+	cache := NewCache(NewMemoryStore(1<<20), 0)
+	handler := CacheMiddleware(cache)(backend)
+
+	for _, xCache := range []string{"MISS", "STALE"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+		assert.Equal(t, xCache, w.Header().Get(XCache))
+	}
+	// the resource is released once the revalidation times out
+	assert.Eventually(t, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return len(cache.calls) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&hits))
+}
+
+func TestCachePerRequestHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the backend echoes the request ID
+		w.Header().Set(XRequestID, r.Header.Get(XRequestID))
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	rules := HeaderRules{Set: map[string]string{"X-Request-Backend": "$request_id@$backend", "X-Scheme": "$scheme"}}
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin", WithHeaders(HeaderConfig{Response: rules}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"X-Request-Backend"}, rules.PerRequest())
+	handler := RequestIDMiddleware()(CacheMiddleware(NewCache(NewMemoryStore(1<<20), 0, rules.PerRequest()...))(httpProxy))
+
+	cases := []struct {
+		name    string
+		id      string
+		xCache  string
+		backend bool
+	}{
+		{"miss", "first", "MISS", true},
+		{"hit", "second", "HIT", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/a", nil)
+			r.Header.Set(XRequestID, c.id)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, c.xCache, w.Header().Get(XCache))
+			// the headers of the request are never those of the stored response
+			assert.Equal(t, c.id, w.Header().Get(XRequestID))
+			assert.Equal(t, c.backend, strings.HasPrefix(w.Header().Get("X-Request-Backend"), c.id+"@"))
+			assert.Equal(t, "http", w.Header().Get("X-Scheme"))
+		})
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+	handler := CacheMiddleware(NewCache(NewMemoryStore(1<<20), 0))(httpProxy)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+			assert.Equal(t, "hello", w.Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&hits))
+}
+
+func TestCacheMaxObjectSize(t *testing.T) {
+	var hits int64
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(strings.Repeat("a", 16)))
+	})
+	handler := CacheMiddleware(NewCache(NewMemoryStore(1<<20), 8))(backend)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+		assert.Equal(t, 16, w.Body.Len())
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&hits))
+}
+
+func TestCacheScheme(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(GetProto(r)))
+	})
+	handler := CacheMiddleware(NewCache(NewMemoryStore(1<<20), 0))(backend)
+
+	// the response of http is never served on https
+	cases := []struct {
+		url    string
+		xCache string
+	}{
+		{"http://example.com/a", "MISS"},
+		{"https://example.com/a", "MISS"},
+		{"http://example.com/a", "HIT"},
+		{"https://example.com/a", "HIT"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.url, nil))
+		assert.Equal(t, c.xCache, w.Header().Get(XCache))
+		assert.Equal(t, strings.SplitN(c.url, ":", 2)[0], w.Body.String())
+	}
+}
+
+func TestCacheStores(t *testing.T) {
+	disk, err := NewDiskStore(t.TempDir(), 3000)
+	assert.Nil(t, err)
+	stores := []struct {
+		name  string
+		store CacheStore
+	}{
+		{"memory", NewMemoryStore(3000)},
+		{"disk", disk},
+	}
+	entry := func(body string) *CacheEntry {
+		return &CacheEntry{Variants: []*CachedResponse{{Status: http.StatusOK, Body: []byte(body)}}}
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			s.store.Set("a", entry(strings.Repeat("a", 1000)))
+			s.store.Set("b", entry(strings.Repeat("b", 1000)))
+			got, ok := s.store.Get("a")
+			assert.True(t, ok)
+			assert.Equal(t, strings.Repeat("a", 1000), string(got.Variants[0].Body))
+
+			// the least recently used entry is evicted
+			s.store.Set("c", entry(strings.Repeat("c", 1000)))
+			_, ok = s.store.Get("b")
+			assert.False(t, ok)
+			_, ok = s.store.Get("a")
+			assert.True(t, ok)
+
+			// an entry larger than the store is not kept
+			s.store.Set("d", entry(strings.Repeat("d", 4000)))
+			_, ok = s.store.Get("d")
+			assert.False(t, ok)
+
+			assert.True(t, s.store.Delete("a"))
+			assert.False(t, s.store.Delete("a"))
+			assert.Equal(t, []string{"c"}, s.store.Keys())
+		})
+	}
+}
+
+func TestCachePurgeHandler(t *testing.T) {
+	cache := NewCache(NewMemoryStore(1<<20), 0)
+	handler := CachePurgeHandler(map[string]*Cache{"/": cache})
+
+	cases := []struct {
+		name   string
+		method string
+		query  string
+		status int
+		purged string
+		keys   int
+	}{
+		{"method not allowed", http.MethodGet, "", http.StatusMethodNotAllowed, "", 4},
+		{"key", http.MethodDelete, "?key=example.com/a", http.StatusOK, `{"purged":1}`, 3},
+		{"unknown key", "PURGE", "?key=example.com/c", http.StatusOK, `{"purged":0}`, 4},
+		{"prefix", "PURGE", "?key=example.com/a&prefix=true", http.StatusOK, `{"purged":2}`, 2},
+		{"key of both schemes", http.MethodDelete, "?key=example.com/b", http.StatusOK, `{"purged":2}`, 2},
+		{"key of a scheme", http.MethodDelete, "?key=https://example.com/b", http.StatusOK, `{"purged":1}`, 3},
+		{"all", http.MethodDelete, "", http.StatusOK, `{"purged":4}`, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, key := range []string{"http://example.com/a", "http://example.com/a/b", "http://example.com/b", "https://example.com/b"} {
+				cache.store.Set(key, &CacheEntry{})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(c.method, "/purge"+c.query, nil))
+			assert.Equal(t, c.status, w.Code)
+			assert.Equal(t, c.purged, strings.TrimSpace(w.Body.String()))
+			assert.Len(t, cache.store.Keys(), c.keys)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// errorMessages describe the failures of the balancer, the errors themselves
+// refer to the backends and are only logged
+var errorMessages = map[int]string{
+	http.StatusInternalServerError:   "the balancer failed to handle the request",
+	http.StatusBadGateway:            "the backend could not be reached",
+	http.StatusServiceUnavailable:    "no backend is available",
+	http.StatusGatewayTimeout:        "the backend did not respond in time",
+	http.StatusRequestEntityTooLarge: "the request body is too large",
+}
+
+// ErrorFormat refers to the format of the error responses, text, html or json
+type ErrorFormat string
+
+const (
+	ErrorText ErrorFormat = "text"
+	ErrorHTML ErrorFormat = "html"
+	// ErrorJSON suits the API locations
+	ErrorJSON ErrorFormat = "json"
+)
+
+// ErrorPage is the file of an error response, a template is executed with ErrorData
+type ErrorPage struct {
+	File     string
+	Template bool
+}
+
+// ErrorPagesConfig refers to the error responses of a location, the statuses
+// without page are written in Format
+type ErrorPagesConfig struct {
+	Format ErrorFormat
+	Pages  map[int]ErrorPage
+}
+
+// ErrorData is the error of a response, it is the data of the templates and
+// the body of the json errors
+type ErrorData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// executor is a parsed template of html/template or text/template
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type errorPage struct {
+	contentType string
+	body        []byte
+	template    executor
+}
+
+// ErrorPages writes the error responses of the balancer itself, the error
+// responses of the backends are kept
+type ErrorPages struct {
+	format ErrorFormat
+	pages  map[int]*errorPage
+}
+
+// NewErrorPages create new ErrorPages, the pages are read once
+func NewErrorPages(config ErrorPagesConfig) (*ErrorPages, error) {
+	e := &ErrorPages{format: config.Format, pages: make(map[int]*errorPage)}
+	if len(e.format) == 0 {
+		e.format = ErrorText
+	}
+	for status, page := range config.Pages {
+		content, err := os.ReadFile(page.File)
+		if err != nil {
+			return nil, err
+		}
+		p := &errorPage{contentType: mime.TypeByExtension(filepath.Ext(page.File)), body: content}
+		if len(p.contentType) == 0 {
+			p.contentType = http.DetectContentType(content)
+		}
+		if page.Template {
+			name := filepath.Base(page.File)
+			if strings.HasPrefix(p.contentType, "text/html") {
+				p.template, err = htmltemplate.New(name).Parse(string(content))
+			} else {
+				p.template, err = template.New(name).Parse(string(content))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		e.pages[status] = p
+	}
+	return e, nil
+}
+
+// defaultErrorPages write the errors as text
+var defaultErrorPages = &ErrorPages{format: ErrorText}
+
+// Write writes the error response of the status for the request
+func (e *ErrorPages) Write(w http.ResponseWriter, r *http.Request, status int) {
+	data := ErrorData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    errorMessages[status],
+	}
+	if len(data.Message) == 0 {
+		data.Message = strings.ToLower(data.StatusText)
+	}
+	if info := GetRequestInfo(r.Context()); info != nil {
+		data.RequestID = info.ID
+	}
+
+	contentType, body := e.render(data)
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// render returns the page of the status, or the error in the format
+func (e *ErrorPages) render(data ErrorData) (string, []byte) {
+	if p, ok := e.pages[data.Status]; ok {
+		if p.template == nil {
+			return p.contentType, p.body
+		}
+		var buf bytes.Buffer
+		if err := p.template.Execute(&buf, data); err == nil {
+			return p.contentType, buf.Bytes()
+		}
+	}
+	switch e.format {
+	case ErrorJSON:
+		body, _ := json.Marshal(data)
+		return "application/json", append(body, '\n')
+	case ErrorHTML:
+		var buf bytes.Buffer
+		_ = defaultErrorTemplate.Execute(&buf, data)
+		return "text/html; charset=utf-8", buf.Bytes()
+	}
+	return "text/plain; charset=utf-8", []byte(strconv.Itoa(data.Status) + " " + data.StatusText + ": " + data.Message + "\n")
+}
+
+var defaultErrorTemplate = htmltemplate.Must(htmltemplate.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>{{end}}
+</body>
+</html>
+`))
+
+// errorStatus returns the status of a failed upstream request, 504 on a
+// timeout and 502 on a connection failure
+func errorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		expect int
+	}{
+		{"connection refused", errors.New("dial tcp 127.0.0.1:1: connect: connection refused"), http.StatusBadGateway},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"timeout", &url.Error{Op: "Get", URL: "http://a", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{"body too large", &http.MaxBytesError{Limit: 1}, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, errorStatus(c.err))
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "503.html"), []byte("<p>down for maintenance</p>"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "502.html"), []byte("<p>{{.Status}} {{.RequestID}}</p>"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "504.json"), []byte(`{"code":{{.Status}}}`), 0o644))
+
+	pages := map[int]ErrorPage{
+		http.StatusServiceUnavailable: {File: filepath.Join(dir, "503.html")},
+		http.StatusBadGateway:         {File: filepath.Join(dir, "502.html"), Template: true},
+		http.StatusGatewayTimeout:     {File: filepath.Join(dir, "504.json"), Template: true},
+	}
+	cases := []struct {
+		name        string
+		format      ErrorFormat
+		status      int
+		contentType string
+		body        string
+	}{
+		{"text", "", http.StatusServiceUnavailable, "text/plain; charset=utf-8", "503 Service Unavailable: no backend is available\n"},
+		{"json", ErrorJSON, http.StatusGatewayTimeout, "application/json",
+			`{"status":504,"error":"Gateway Timeout","message":"the backend did not respond in time","request_id":"abc"}` + "\n"},
+		{"html", ErrorHTML, http.StatusBadGateway, "text/html; charset=utf-8", "<h1>502 Bad Gateway</h1>"},
+		{"static page", ErrorJSON, http.StatusServiceUnavailable, "text/html; charset=utf-8", "<p>down for maintenance</p>"},
+		{"template page", ErrorJSON, http.StatusBadGateway, "text/html; charset=utf-8", "<p>502 abc</p>"},
+		{"json template page", ErrorText, http.StatusGatewayTimeout, "application/json", `{"code":504}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := ErrorPagesConfig{Format: c.format}
+			if strings.Contains(c.name, "page") {
+				config.Pages = pages
+			}
+			e, err := NewErrorPages(config)
+			assert.Nil(t, err)
+
+			r, info := WithRequestInfo(httptest.NewRequest(http.MethodGet, "/", nil))
+			info.ID = "abc"
+			w := httptest.NewRecorder()
+			e.Write(w, r, c.status)
+			assert.Equal(t, c.status, w.Code)
+			assert.Equal(t, c.contentType, w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), c.body)
+			if c.format == ErrorJSON && !strings.Contains(c.name, "page") {
+				assert.True(t, json.Valid(w.Body.Bytes()))
+			}
+		})
+	}
+
+	_, err := NewErrorPages(ErrorPagesConfig{Pages: map[int]ErrorPage{http.StatusBadGateway: {File: filepath.Join(dir, "missing.html")}}})
+	assert.NotNil(t, err)
+}
+
+func TestHTTPProxy_ErrorStatus(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	pages, err := NewErrorPages(ErrorPagesConfig{Format: ErrorJSON})
+	assert.Nil(t, err)
+	cases := []struct {
+		name   string
+		host   string
+		noHost bool
+		status int
+	}{
+		{"connection failure", closed.URL, false, http.StatusBadGateway},
+		{"timeout", slow.URL, false, http.StatusGatewayTimeout},
+		{"no host alive", slow.URL, true, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			httpProxy, err := NewHTTPProxy([]string{c.host}, "round-robin",
+				WithTransport(TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond}),
+				WithErrorPages(pages))
+			assert.Nil(t, err)
+			if c.noHost {
+				u, _ := url.Parse(c.host)
+				httpProxy.lb.Remove(GetHost(u))
+			}
+
+			w := httptest.NewRecorder()
+			httpProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, c.status, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var data ErrorData
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &data))
+			assert.Equal(t, c.status, data.Status)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	GRPCStatus  = http.CanonicalHeaderKey("Grpc-Status")
+	GRPCMessage = http.CanonicalHeaderKey("Grpc-Message")
+)
+
+// IsGRPC reports whether the request is a gRPC call
+func IsGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCError answers a gRPC call with a trailers-only response, as gRPC
+// clients ignore the body and the http status of a failed call
+func writeGRPCError(w http.ResponseWriter, code grpccodes.Code, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(GRPCStatus, strconv.Itoa(int(code)))
+	w.Header().Set(GRPCMessage, grpcEncodeMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEncodeMessage percent-encodes the message as required by the gRPC over http/2 spec
+func grpcEncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(c)|0x100, 16)[1:]))
+	}
+	return b.String()
+}
+
+// grpcProtocols returns the protocols of the transport to a gRPC backend,
+// http/2 over tls for https and h2c with prior knowledge otherwise
+func grpcProtocols(scheme string) *http.Protocols {
+	protocols := &http.Protocols{}
+	if scheme == "https" {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return protocols
+}
+
+// IsBackendAliveGRPC calls the standard `grpc.health.v1` service of the host,
+// it is alive when `service` is SERVING. A nil tls configuration refers to h2c.
+func IsBackendAliveGRPC(host string, config *tls.Config, service string) bool {
+	creds := insecure.NewCredentials()
+	if config != nil {
+		creds = credentials.NewTLS(config)
+	}
+	conn, err := grpc.NewClient(host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return false
+	}
+	return resp.Status == healthpb.HealthCheckResponse_SERVING
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// h2cBalancer serves the proxy with h2c, like a listener with `h2c: true`
+func h2cBalancer(h http.Handler) *httptest.Server {
+	balancer := httptest.NewUnstartedServer(h)
+	balancer.Config.Protocols = &http.Protocols{}
+	balancer.Config.Protocols.SetHTTP1(true)
+	balancer.Config.Protocols.SetUnencryptedHTTP2(true)
+	balancer.Start()
+	return balancer
+}
+
+func healthCheck(t *testing.T, addr string) (*healthpb.HealthCheckResponse, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+}
+
+func TestHTTPProxy_GRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	backend := grpc.NewServer()
+	healthpb.RegisterHealthServer(backend, health.NewServer())
+	go func() { _ = backend.Serve(ln) }()
+	defer backend.Stop()
+
+	assert.Equal(t, true, IsBackendAliveGRPC(ln.Addr().String(), nil, ""))
+
+	httpProxy, err := NewHTTPProxy([]string{"http://" + ln.Addr().String()}, "round-robin",
+		WithGRPC(), WithGRPCHealthCheck(""))
+	assert.Nil(t, err)
+	balancer := h2cBalancer(httpProxy)
+	defer balancer.Close()
+
+	resp, err := healthCheck(t, balancer.Listener.Addr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestHTTPProxy_GRPCError(t *testing.T) {
+	// nothing listens on the backend
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	assert.Equal(t, false, IsBackendAliveGRPC(addr, nil, ""))
+
+	httpProxy, err := NewHTTPProxy([]string{"http://" + addr}, "round-robin", WithGRPC())
+	assert.Nil(t, err)
+	balancer := h2cBalancer(httpProxy)
+	defer balancer.Close()
+
+	_, err = healthCheck(t, balancer.Listener.Addr().String())
+	assert.Equal(t, grpccodes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"os"
+)
+
+// BackendHeaders identify the software of the backends, they are removed
+// from the responses when the backends are hidden
+var BackendHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+
+// HeaderRules refers to the headers removed, set and appended, in that order,
+// the values may refer to the variables `$client_ip`, `$backend`,
+// `$request_id`, `$host` and `$scheme` of the request
+type HeaderRules struct {
+	Remove []string
+	Set    map[string]string
+	Append map[string]string
+}
+
+// HeaderConfig refers to the headers of the upstream requests and of the
+// responses of a location
+type HeaderConfig struct {
+	Request  HeaderRules
+	Response HeaderRules
+	// HideBackend removes BackendHeaders from the responses
+	HideBackend bool
+}
+
+// PerRequest returns the headers set or appended with `$client_ip`,
+// `$backend` or `$request_id`, their values differ between the requests of a resource
+func (rules *HeaderRules) PerRequest() []string {
+	headers := make([]string, 0)
+	for _, values := range []map[string]string{rules.Set, rules.Append} {
+		for key, value := range values {
+			perRequest := false
+			os.Expand(value, func(name string) string {
+				if name == "client_ip" || name == "backend" || name == "request_id" {
+					perRequest = true
+				}
+				return ""
+			})
+			if perRequest {
+				headers = append(headers, key)
+			}
+		}
+	}
+	return headers
+}
+
+// headerVars are the values of the variables of the header rules
+type headerVars struct {
+	clientIP  string
+	backend   string
+	requestID string
+	host      string
+	scheme    string
+}
+
+type headerVarsKey struct{}
+
+// withHeaderVars stores the variables of the request proxied to `backend` in the context
+func withHeaderVars(ctx context.Context, r *http.Request, backend string) context.Context {
+	vars := &headerVars{
+		clientIP: GetIP(r),
+		backend:  backend,
+		host:     r.Host,
+		scheme:   GetProto(r),
+	}
+	if info := GetRequestInfo(r.Context()); info != nil {
+		vars.requestID = info.ID
+	}
+	return context.WithValue(ctx, headerVarsKey{}, vars)
+}
+
+// expand replaces the variables of the value, unknown variables are kept
+func (v *headerVars) expand(value string) string {
+	return os.Expand(value, func(name string) string {
+		switch name {
+		case "client_ip":
+			return v.clientIP
+		case "backend":
+			return v.backend
+		case "request_id":
+			return v.requestID
+		case "host":
+			return v.host
+		case "scheme":
+			return v.scheme
+		}
+		return "$" + name
+	})
+}
+
+// apply modifies the headers according to the rules
+func (rules *HeaderRules) apply(ctx context.Context, header http.Header) {
+	if len(rules.Remove) == 0 && len(rules.Set) == 0 && len(rules.Append) == 0 {
+		return
+	}
+	vars, _ := ctx.Value(headerVarsKey{}).(*headerVars)
+	if vars == nil {
+		vars = &headerVars{}
+	}
+	for _, key := range rules.Remove {
+		header.Del(key)
+	}
+	for key, value := range rules.Set {
+		header.Set(key, vars.expand(value))
+	}
+	for key, value := range rules.Append {
+		header.Add(key, vars.expand(value))
+	}
+}
+
+// modifyResponse applies the response rules and hides the backend
+func (c *HeaderConfig) modifyResponse(resp *http.Response) {
+	if c.HideBackend {
+		for _, key := range BackendHeaders {
+			resp.Header.Del(key)
+		}
+	}
+	c.Response.apply(resp.Request.Context(), resp.Header)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPProxy_Headers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request headers are echoed as response headers
+		for _, key := range []string{"X-Client", "X-Route", "X-Debug", "X-Unknown"} {
+			w.Header()["Echo-"+key] = r.Header.Values(key)
+		}
+		w.Header().Set("Server", "nginx/1.25")
+		w.Header().Set("X-Powered-By", "PHP")
+		w.Header().Set("X-Internal", "1")
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin", WithHeaders(HeaderConfig{
+		Request: HeaderRules{
+			Remove: []string{"X-Debug"},
+			Set:    map[string]string{"X-Client": "$client_ip", "X-Unknown": "${unknown}"},
+			Append: map[string]string{"X-Route": "${scheme}://$host via $backend"},
+		},
+		Response: HeaderRules{
+			Remove: []string{"X-Internal"},
+			Set:    map[string]string{"X-Request-Backend": "$request_id@$backend"},
+		},
+		HideBackend: true,
+	}))
+	assert.Nil(t, err)
+	handler := RequestIDMiddleware()(httpProxy)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	req.Host = "example.com"
+	req.Header.Set(XRequestID, "abc")
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-Route", "edge")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	cases := []struct {
+		name   string
+		header string
+		expect []string
+	}{
+		{"set", "Echo-X-Client", []string{"203.0.113.7"}},
+		{"append", "Echo-X-Route", []string{"edge", "http://example.com via " + u.Host}},
+		{"remove", "Echo-X-Debug", nil},
+		{"unknown variable", "Echo-X-Unknown", []string{"$unknown"}},
+		{"response set", "X-Request-Backend", []string{"abc@" + u.Host}},
+		{"response remove", "X-Internal", nil},
+		{"hide server", "Server", nil},
+		{"hide powered by", "X-Powered-By", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, w.Header().Values(c.header))
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"log"
 	"time"
 )
@@ -26,20 +27,44 @@ func (h *HTTPProxy) HealthCheck(interval uint) {
 	}
 }
 
+// isBackendAlive checks the host with the grpc health protocol if enabled,
+// with a tls handshake for https backends with an upstream tls configuration,
+// and with a tcp connection otherwise
+func (h *HTTPProxy) isBackendAlive(host string) bool {
+	if h.grpcHealthCheck {
+		var config *tls.Config
+		if h.tlsHosts[host] {
+			config = &tls.Config{}
+			if h.tlsConfig != nil {
+				config = h.tlsConfig
+			}
+		}
+		return IsBackendAliveGRPC(host, config, h.grpcHealthService)
+	}
+	if h.tlsConfig != nil && h.tlsHosts[host] {
+		return IsBackendAliveTLS(host, h.tlsConfig)
+	}
+	return IsBackendAlive(host)
+}
+
 func (h *HTTPProxy) healthCheck(host string, interval uint) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 
 	for range ticker.C {
-		if !IsBackendAlive(host) && h.ReadAlive(host) {
+		alive := h.isBackendAlive(host)
+		if !alive && h.ReadAlive(host) {
 			log.Printf("Host is unreachable, remove %s from load balancer.", host)
 
 			h.SetAlive(host, false)
 			h.lb.Remove(host)
-		} else if IsBackendAlive(host) && !h.ReadAlive(host) {
+			h.upgradeLB.Remove(host)
+			h.drainTunnels(host)
+		} else if alive && !h.ReadAlive(host) {
 			log.Printf("Host is reachable, add %s to load balancer.", host)
 
 			h.SetAlive(host, true)
 			h.lb.Add(host)
+			h.upgradeLB.Add(host)
 		}
 	}
 
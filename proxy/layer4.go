@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"go-balancer/balancers"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layer4 refers to the backends of a tcp or udp proxy, their health is
+// checked with tcp connections
+type layer4 struct {
+	sync.RWMutex
+	hosts []string
+	lb    balancers.Balancer
+	alive map[string]bool
+	mode  string
+}
+
+// newLayer4 parses the `host:port`, or `scheme://host:port`, of the backends
+func newLayer4(targetHosts []string, algorithm string) (*layer4, error) {
+	hosts := make([]string, 0)
+	alive := make(map[string]bool)
+	for _, targetHost := range targetHosts {
+		host := targetHost
+		if strings.Contains(targetHost, "://") {
+			u, err := url.Parse(targetHost)
+			if err != nil {
+				return nil, err
+			}
+			host = u.Host
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return nil, err
+		}
+		alive[host] = true
+		hosts = append(hosts, host)
+	}
+
+	lb, err := balancers.Build(algorithm, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &layer4{
+		hosts: hosts,
+		lb:    lb,
+		alive: alive,
+		mode:  algorithm,
+	}, nil
+}
+
+// ReadAlive reads the alive status of the host
+func (l *layer4) ReadAlive(host string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.alive[host]
+}
+
+// SetAlive sets the alive status to the host
+func (l *layer4) SetAlive(host string, alive bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.alive[host] = alive
+}
+
+// HealthCheck enable a health check goroutine for each backend, the check
+// opens a tcp connection to the host
+func (l *layer4) HealthCheck(interval uint) {
+	for _, host := range l.hosts {
+		go l.healthCheck(host, interval)
+	}
+}
+
+func (l *layer4) healthCheck(host string, interval uint) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+
+	for range ticker.C {
+		alive := IsBackendAlive(host)
+		if !alive && l.ReadAlive(host) {
+			log.Printf("Host is unreachable, remove %s from load balancer.", host)
+
+			l.SetAlive(host, false)
+			l.lb.Remove(host)
+		} else if alive && !l.ReadAlive(host) {
+			log.Printf("Host is reachable, add %s to load balancer.", host)
+
+			l.SetAlive(host, true)
+			l.lb.Add(host)
+		}
+	}
+}
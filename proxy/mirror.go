@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"go-balancer/balancers"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MirrorTimeout refers to the timeout of the mirrored requests used when none is configured
+var MirrorTimeout = 10 * time.Second
+
+// XMirror marks the requests sent to the shadow pool
+var XMirror = http.CanonicalHeaderKey("X-Mirror")
+
+// MirrorConfig refers to the shadow pool receiving a copy of the requests of a location
+type MirrorConfig struct {
+	// Hosts are the URLs of the shadow backends, balanced with BalanceMode
+	Hosts       []string
+	BalanceMode string
+	// Percentage of the requests mirrored, between 0 and 100
+	Percentage float64
+	// MaxBodySize bounds the copied request bodies, larger requests are not
+	// mirrored, nor are the requests whose body the backend does not read
+	// entirely, 0 keeps 1MB
+	MaxBodySize int64
+	// Timeout bounds each mirrored request, so that a stalled shadow pool
+	// releases its slots, 0 keeps MirrorTimeout
+	Timeout time.Duration
+	// MaxInflight bounds the mirrored requests in flight, the others are
+	// dropped, 0 keeps 100
+	MaxInflight int
+	TLSConfig   *tls.Config
+}
+
+// MirrorStats are the outcomes of the mirrored requests, apart from the
+// statistics of the location
+type MirrorStats struct {
+	Sent      int64 `json:"sent"`
+	Status2xx int64 `json:"status_2xx"`
+	Status3xx int64 `json:"status_3xx"`
+	Status4xx int64 `json:"status_4xx"`
+	Status5xx int64 `json:"status_5xx"`
+	// Errors are the mirrored requests without response, such as timeouts
+	Errors int64 `json:"errors"`
+	// Dropped are the requests not mirrored as MaxInflight was reached
+	Dropped int64 `json:"dropped"`
+	// Skipped are the requests not mirrored as their body exceeds MaxBodySize
+	Skipped int64 `json:"skipped"`
+}
+
+func (s *MirrorStats) snapshot() MirrorStats {
+	return MirrorStats{
+		Sent:      atomic.LoadInt64(&s.Sent),
+		Status2xx: atomic.LoadInt64(&s.Status2xx),
+		Status3xx: atomic.LoadInt64(&s.Status3xx),
+		Status4xx: atomic.LoadInt64(&s.Status4xx),
+		Status5xx: atomic.LoadInt64(&s.Status5xx),
+		Errors:    atomic.LoadInt64(&s.Errors),
+		Dropped:   atomic.LoadInt64(&s.Dropped),
+		Skipped:   atomic.LoadInt64(&s.Skipped),
+	}
+}
+
+// hopHeaders are the hop-by-hop headers, they are not mirrored
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// Mirror sends a copy of a percentage of the requests to a shadow pool, fire
+// and forget, the shadow responses never reach the clients
+type Mirror struct {
+	config    MirrorConfig
+	lb        balancers.Balancer
+	directors map[string]func(*http.Request)
+	client    *http.Client
+	inflight  chan struct{}
+	stats     MirrorStats
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewMirror create new Mirror to the shadow pool of the configuration, the
+// mirrored requests are rewritten and carry the headers of the options of
+// the location, as the requests of its backends
+func NewMirror(config MirrorConfig, opts ...Option) (*Mirror, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	hosts := make([]string, 0, len(config.Hosts))
+	directors := make(map[string]func(*http.Request))
+	for _, targetHost := range config.Hosts {
+		u, err := url.Parse(targetHost)
+		if err != nil {
+			return nil, err
+		}
+		host := GetHost(u)
+		directors[host] = newDirector(o, httputil.NewSingleHostReverseProxy(u).Director)
+		hosts = append(hosts, host)
+	}
+	lb, err := balancers.Build(config.BalanceMode, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = MirrorTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = config.Timeout
+	if config.TLSConfig != nil {
+		transport.TLSClientConfig = config.TLSConfig.Clone()
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 1 << 20
+	}
+	if config.MaxInflight <= 0 {
+		config.MaxInflight = 100
+	}
+	return &Mirror{
+		config:    config,
+		lb:        lb,
+		directors: directors,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+			// redirects of the shadow pool are not followed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inflight: make(chan struct{}, config.MaxInflight),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Stats returns the outcomes of the mirrored requests
+func (m *Mirror) Stats() MirrorStats {
+	return m.stats.snapshot()
+}
+
+// sample reports whether the next request is mirrored
+func (m *Mirror) sample() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rnd.Float64()*100 < m.config.Percentage
+}
+
+// mirrorBody copies the body of the request while the backend reads it,
+// up to MaxBodySize
+type mirrorBody struct {
+	io.ReadCloser
+	limit  int64
+	length int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	read     int64
+	eof      bool
+	overflow bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += int64(n)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// complete returns the copy of the body, it reports false unless the
+// backend read the whole body within MaxBodySize
+func (b *mirrorBody) complete() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.overflow || (!b.eof && (b.length <= 0 || b.read < b.length)) {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
+
+// send mirrors the request with its body to a host of the shadow pool
+func (m *Mirror) send(r *http.Request, body []byte) {
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		atomic.AddInt64(&m.stats.Dropped, 1)
+		return
+	}
+
+	host, err := m.lb.Balance(GetIP(r))
+	if err != nil {
+		<-m.inflight
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return
+	}
+
+	// the mirrored request outlives the request of the client, it is built by
+	// the director of the location as the request of a backend
+	req := r.Clone(withHeaderVars(context.WithoutCancel(r.Context()), r, host))
+	req.RequestURI = ""
+	req.Body, req.GetBody, req.ContentLength = http.NoBody, nil, int64(len(body))
+	if len(body) != 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	m.directors[host](req)
+	for _, key := range hopHeaders {
+		req.Header.Del(key)
+	}
+	// the peer is appended to `X-Forwarded-For` as by the reverse proxy
+	clientIP := remoteIP(r)
+	if prior := req.Header.Values(XForwardedFor); len(prior) != 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	req.Header.Set(XForwardedFor, clientIP)
+	req.Header.Set(XMirror, "1")
+
+	atomic.AddInt64(&m.stats.Sent, 1)
+	m.lb.Inc(host)
+	go func() {
+		defer func() { <-m.inflight }()
+		defer m.lb.Done(host)
+		resp, err := m.client.Do(req)
+		if err != nil {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 500:
+			atomic.AddInt64(&m.stats.Status5xx, 1)
+		case resp.StatusCode >= 400:
+			atomic.AddInt64(&m.stats.Status4xx, 1)
+		case resp.StatusCode >= 300:
+			atomic.AddInt64(&m.stats.Status3xx, 1)
+		default:
+			atomic.AddInt64(&m.stats.Status2xx, 1)
+		}
+	}()
+}
+
+// MirrorMiddleware mirrors a percentage of the requests, upgraded connections
+// are not mirrored. A request without body is mirrored before it is proxied,
+// the body of the others is copied as the backend reads it, and they are
+// mirrored once proxied, so the client never waits for the copy.
+func MirrorMiddleware(m *Mirror) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsUpgrade(r) || !m.sample() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Body == nil || r.Body == http.NoBody {
+				m.send(r, nil)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > m.config.MaxBodySize {
+				atomic.AddInt64(&m.stats.Skipped, 1)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body := &mirrorBody{ReadCloser: r.Body, limit: m.config.MaxBodySize, length: r.ContentLength}
+			r.Body = body
+			next.ServeHTTP(w, r)
+			if b, ok := body.complete(); ok {
+				m.send(r, b)
+			} else {
+				atomic.AddInt64(&m.stats.Skipped, 1)
+			}
+		})
+	}
+}
+
+// MirrorStatsHandler reports the outcomes of the mirrored requests of each location as JSON
+func MirrorStatsHandler(mirrors map[string]*Mirror) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := make(map[string]MirrorStats, len(mirrors))
+		for name, m := range mirrors {
+			reply[name] = m.Stats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(reply)
+	})
+}
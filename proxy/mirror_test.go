@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrorMiddleware(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// a slow and failing shadow never affects the client
+		time.Sleep(200 * time.Millisecond)
+		mirrored <- r.Method + " " + r.URL.RequestURI() + " " + string(body) + " " + r.Header.Get(XMirror) + " " + r.Host
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{primary.URL}, "round-robin")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		name       string
+		percentage float64
+		body       string
+		rewrite    RewriteConfig
+		timeout    time.Duration
+		mirrored   string
+		stats      MirrorStats
+	}{
+		{"mirrored", 100, "hello", RewriteConfig{}, 0, "POST /a?b=c hello 1 example.com", MirrorStats{Sent: 1, Status5xx: 1}},
+		{"not sampled", 0, "hello", RewriteConfig{}, 0, "", MirrorStats{}},
+		{"body too large", 100, "hello world", RewriteConfig{}, 0, "", MirrorStats{Skipped: 1}},
+		{"rewritten", 100, "hello", RewriteConfig{StripPrefix: "/a", AddPrefix: "/v2", Host: "api.internal"}, 0,
+			"POST /v2/?b=c hello 1 api.internal", MirrorStats{Sent: 1, Status5xx: 1}},
+		// the slot of a stalled shadow request is released
+		{"timeout", 100, "hello", RewriteConfig{}, 50 * time.Millisecond, "", MirrorStats{Sent: 1, Errors: 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mirror, err := NewMirror(MirrorConfig{
+				Hosts:       []string{shadow.URL},
+				BalanceMode: "round-robin",
+				Percentage:  c.percentage,
+				MaxBodySize: 8,
+				Timeout:     c.timeout,
+			}, WithRewrite(c.rewrite))
+			assert.Nil(t, err)
+			handler := MirrorMiddleware(mirror)(httpProxy)
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/a?b=c", strings.NewReader(c.body)))
+			assert.Less(t, time.Since(start), 150*time.Millisecond)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, c.body, w.Body.String())
+
+			if len(c.mirrored) != 0 {
+				assert.Equal(t, c.mirrored, <-mirrored)
+			}
+			assert.Eventually(t, func() bool { return mirror.Stats() == c.stats }, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestMirror_Headers(t *testing.T) {
+	mirrored := make(chan http.Header, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Header
+	}))
+	defer shadow.Close()
+	u, _ := url.Parse(shadow.URL)
+
+	mirror, err := NewMirror(MirrorConfig{Hosts: []string{shadow.URL}, BalanceMode: "round-robin", Percentage: 100},
+		WithHeaders(HeaderConfig{Request: HeaderRules{Set: map[string]string{"X-Route": "$backend"}}}))
+	assert.Nil(t, err)
+	handler := RequestIDMiddleware()(MirrorMiddleware(mirror)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	req.Header.Set(XRequestID, "abc")
+	req.Header.Set("Connection", "close")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the shadow pool receives the headers of the backends of the location
+	header := <-mirrored
+	cases := []struct {
+		name   string
+		header string
+		expect string
+	}{
+		{"mirror", XMirror, "1"},
+		{"forwarded for", XForwardedFor, "203.0.113.7"},
+		{"forwarded proto", XForwardedProto, "http"},
+		{"real ip", XRealIP, "203.0.113.7"},
+		{"request id", XRequestID, "abc"},
+		{"header rule", "X-Route", u.Host},
+		{"hop header", "Connection", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, header.Get(c.header))
+		})
+	}
+}
+
+func TestMirrorMiddleware_Body(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- string(body)
+	}))
+	defer shadow.Close()
+
+	cases := []struct {
+		name     string
+		length   int64
+		read     bool
+		mirrored string
+		stats    MirrorStats
+	}{
+		{"unknown length", -1, true, "hello", MirrorStats{Sent: 1, Status2xx: 1}},
+		{"unknown length too large", -1, true, "", MirrorStats{Skipped: 1}},
+		{"body not read", 5, false, "", MirrorStats{Skipped: 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mirror, err := NewMirror(MirrorConfig{Hosts: []string{shadow.URL}, BalanceMode: "round-robin", Percentage: 100, MaxBodySize: 8})
+			assert.Nil(t, err)
+			var received string
+			handler := MirrorMiddleware(mirror)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if c.read {
+					body, _ := io.ReadAll(r.Body)
+					received = string(body)
+				}
+			}))
+
+			body := "hello"
+			if len(c.mirrored) == 0 && c.read {
+				body = "hello world"
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req.ContentLength = c.length
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			// the backend receives the whole body whatever is mirrored
+			if c.read {
+				assert.Equal(t, body, received)
+			}
+			if len(c.mirrored) != 0 {
+				assert.Equal(t, c.mirrored, <-mirrored)
+			}
+			assert.Eventually(t, func() bool { return mirror.Stats() == c.stats }, time.Second, 10*time.Millisecond)
+		})
+	}
+}
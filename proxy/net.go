@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -12,23 +14,171 @@ import (
 // ConnectionTimeout refers to connection timeout for health check
 var ConnectionTimeout = 3 * time.Second
 
-// GetIP get client IP
-func GetIP(r *http.Request) string {
-	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-	if len(r.Header.Get(XForwardedFor)) != 0 {
-		xff := r.Header.Get(XForwardedFor)
-		s := strings.Index(xff, ", ")
-		if s == -1 {
-			s = len(r.Header.Get(XForwardedFor))
+// TrustedProxies refers to the networks of the proxies in front of the balancer,
+// forwarding headers are only honored on requests coming from them
+var TrustedProxies []*net.IPNet
+
+// SetTrustedProxies parses the CIDRs, or single IPs, of the trusted proxies
+func SetTrustedProxies(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy \"%s\"", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	TrustedProxies = nets
+	return nil
+}
+
+// IsTrustedProxy reports whether the ip belongs to a trusted proxy
+func IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range TrustedProxies {
+		if n.Contains(parsed) {
+			return true
 		}
-		clientIP = xff[:s]
-	} else if len(r.Header.Get(XRealIP)) != 0 {
-		clientIP = r.Header.Get(XRealIP)
+	}
+	return false
+}
+
+// GetIP get client IP, the forwarding headers are walked from right to left
+// and the first hop that is not a trusted proxy is the client
+func GetIP(r *http.Request) string {
+	clientIP := remoteIP(r)
+	if !IsTrustedProxy(clientIP) {
+		return clientIP
+	}
+
+	var hops []string
+	if forwarded := r.Header.Values(Forwarded); len(forwarded) != 0 {
+		hops = parseForwarded(forwarded)
+	} else if xff := r.Header.Values(XForwardedFor); len(xff) != 0 {
+		hops = parseXForwardedFor(xff)
+	} else if realIP := r.Header.Get(XRealIP); len(realIP) != 0 {
+		hops = []string{strings.TrimSpace(realIP)}
 	}
 
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// an obfuscated or unknown hop, the last trusted proxy is the best we know
+			break
+		}
+		clientIP = hops[i]
+		if !IsTrustedProxy(clientIP) {
+			break
+		}
+	}
 	return clientIP
 }
 
+// AdminHandler serves the requests of loopback and trusted proxy peers, such
+// as the status endpoints of the balancer, the other peers are forbidden
+func AdminHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if parsed := net.ParseIP(ip); parsed == nil || (!parsed.IsLoopback() && !IsTrustedProxy(ip)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP returns the ip of the peer of the connection
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// parseXForwardedFor returns the hops of the `X-Forwarded-For` headers in order
+func parseXForwardedFor(values []string) []string {
+	hops := make([]string, 0)
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwarded returns the `for` parameters of the RFC 7239 `Forwarded`
+// headers in order, without quotes, brackets and ports
+func parseForwarded(values []string) []string {
+	hops := make([]string, 0)
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			hop := "unknown"
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hop = forwardedNode(strings.Trim(value, "\""))
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the port of a `Forwarded` node, such as
+// `192.0.2.60:4711` or `[2001:db8:cafe::17]:4711`
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end != -1 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// GetProto get the scheme of the request as seen by the client
+func GetProto(r *http.Request) string {
+	if IsTrustedProxy(remoteIP(r)) {
+		if proto := r.Header.Get(XForwardedProto); len(proto) != 0 {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// GetForwardedHost get the host of the request as seen by the client
+func GetForwardedHost(r *http.Request) string {
+	if IsTrustedProxy(remoteIP(r)) {
+		if host := r.Header.Get(XForwardedHost); len(host) != 0 {
+			return host
+		}
+	}
+	return r.Host
+}
+
 // GetHost get the hostname, looks like IP:Port
 func GetHost(url *url.URL) string {
 	if _, _, err := net.SplitHostPort(url.Host); err == nil {
@@ -49,7 +199,7 @@ func IsBackendAlive(host string) bool {
 		return false
 	}
 
-	resolveAddr := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	resolveAddr := net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
 	conn, err := net.DialTimeout("tcp", resolveAddr, ConnectionTimeout)
 	if err != nil {
 		return false
@@ -58,3 +208,19 @@ func IsBackendAlive(host string) bool {
 
 	return true
 }
+
+// IsBackendAliveTLS Attempt to complete a tls handshake to determine whether the site is alive
+func IsBackendAliveTLS(host string, config *tls.Config) bool {
+	config = config.Clone()
+	if len(config.ServerName) == 0 {
+		config.ServerName, _, _ = net.SplitHostPort(host)
+	}
+	dialer := &net.Dialer{Timeout: ConnectionTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, config)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
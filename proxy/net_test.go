@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetIP(t *testing.T) {
+	assert.Nil(t, SetTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"}))
+	defer func() { TrustedProxies = nil }()
+
+	cases := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		expect  string
+	}{
+		{
+			"untrusted peer",
+			"203.0.113.9:1234",
+			map[string]string{XForwardedFor: "1.1.1.1"},
+			"203.0.113.9",
+		},
+		{
+			"trusted peer",
+			"10.0.0.2:1234",
+			map[string]string{XForwardedFor: "1.1.1.1"},
+			"1.1.1.1",
+		},
+		{
+			"spoofed hop",
+			"10.0.0.2:1234",
+			map[string]string{XForwardedFor: "6.6.6.6,1.1.1.1 ,10.0.0.3"},
+			"1.1.1.1",
+		},
+		{
+			"all trusted",
+			"10.0.0.2:1234",
+			map[string]string{XForwardedFor: "10.0.0.4, 10.0.0.3"},
+			"10.0.0.4",
+		},
+		{
+			"forwarded",
+			"[2001:db8::1]:443",
+			map[string]string{
+				Forwarded:     `for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.3`,
+				XForwardedFor: "7.7.7.7",
+			},
+			"2001:db8:cafe::17",
+		},
+		{
+			"forwarded unknown",
+			"10.0.0.2:1234",
+			map[string]string{Forwarded: "for=unknown, for=10.0.0.3:80"},
+			"10.0.0.3",
+		},
+		{
+			"real ip",
+			"10.0.0.2:1234",
+			map[string]string{XRealIP: "1.1.1.1"},
+			"1.1.1.1",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = c.remote
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, c.expect, GetIP(req))
+		})
+	}
+}
+
+func TestDirectorForwardedHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer backend.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	req.Header.Set(XForwardedFor, "6.6.6.6")
+	req.Header.Set(XForwardedProto, "https")
+	req.Header.Set(XForwardedHost, "evil.com")
+	httpProxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "203.0.113.9", received.Get(XForwardedFor))
+	assert.Equal(t, "203.0.113.9", received.Get(XRealIP))
+	assert.Equal(t, "http", received.Get(XForwardedProto))
+	assert.Equal(t, "example.com", received.Get(XForwardedHost))
+}
+
+func TestAdminHandler(t *testing.T) {
+	assert.Nil(t, SetTrustedProxies([]string{"10.0.0.0/8"}))
+	defer func() { TrustedProxies = nil }()
+
+	handler := AdminHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		name   string
+		remote string
+		status int
+	}{
+		{"loopback", "127.0.0.1:1234", http.StatusOK},
+		{"loopback ipv6", "[::1]:1234", http.StatusOK},
+		{"trusted proxy", "10.0.0.2:1234", http.StatusOK},
+		{"internet client", "203.0.113.9:1234", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/balancer/pools", nil)
+			req.RemoteAddr = c.remote
+			// the forwarding headers of the client are not trusted
+			req.Header.Set(XForwardedFor, "127.0.0.1")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, c.status, w.Code)
+		})
+	}
+}
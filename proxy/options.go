@@ -0,0 +1,106 @@
+package proxy
+
+import "crypto/tls"
+
+// Option configures the HTTPProxy created by NewHTTPProxy
+type Option func(*options)
+
+// options holds the per-location settings of a HTTPProxy
+type options struct {
+	proxyProtocol int
+	tlsConfig     *tls.Config
+	transport     TransportConfig
+	upgrade       UpgradeConfig
+	udp           UDPConfig
+	tcp           TCPConfig
+	rewrite       RewriteConfig
+	headers       HeaderConfig
+	errorPages    *ErrorPages
+
+	grpc              bool
+	grpcHealthCheck   bool
+	grpcHealthService string
+}
+
+// WithProxyProtocol sends a PROXY protocol header of `version` 1 or 2 with
+// the client address on every upstream connection, keep-alive to the backends
+// is then disabled as each connection carries a single client
+func WithProxyProtocol(version int) Option {
+	return func(o *options) {
+		o.proxyProtocol = version
+	}
+}
+
+// WithUpstreamTLS uses the tls configuration to connect to https backends
+// and to check their health
+func WithUpstreamTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithTransport tunes the connection pool and the timeouts to the backends
+func WithTransport(config TransportConfig) Option {
+	return func(o *options) {
+		o.transport = config
+	}
+}
+
+// WithUpgrade configures the handling of upgraded connections
+func WithUpgrade(config UpgradeConfig) Option {
+	return func(o *options) {
+		o.upgrade = config
+	}
+}
+
+// WithRewrite rewrites the path and the Host header of the upstream requests
+func WithRewrite(config RewriteConfig) Option {
+	return func(o *options) {
+		o.rewrite = config
+	}
+}
+
+// WithHeaders modifies the headers of the upstream requests and of the responses
+func WithHeaders(config HeaderConfig) Option {
+	return func(o *options) {
+		o.headers = config
+	}
+}
+
+// WithGRPC talks http/2 to the backends, h2c to http backends, so that the
+// calls of a client connection are balanced one by one
+func WithGRPC() Option {
+	return func(o *options) {
+		o.grpc = true
+	}
+}
+
+// WithGRPCHealthCheck checks the health of the backends with the standard
+// `grpc.health.v1` protocol for `service`, empty refers to the whole server
+func WithGRPCHealthCheck(service string) Option {
+	return func(o *options) {
+		o.grpcHealthCheck = true
+		o.grpcHealthService = service
+	}
+}
+
+// WithTCP configures the connections of a tcp proxy
+func WithTCP(config TCPConfig) Option {
+	return func(o *options) {
+		o.tcp = config
+	}
+}
+
+// WithUDP configures the sessions of a udp proxy
+func WithUDP(config UDPConfig) Option {
+	return func(o *options) {
+		o.udp = config
+	}
+}
+
+// WithErrorPages writes the error responses of the proxy with the pages
+func WithErrorPages(pages *ErrorPages) Option {
+	return func(o *options) {
+		o.errorPages = pages
+	}
+}
@@ -1,19 +1,29 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"go-balancer/balancers"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	grpccodes "google.golang.org/grpc/codes"
 )
 
 var (
 	XRealIP       = http.CanonicalHeaderKey("X-Real-IP")
 	XProxy        = http.CanonicalHeaderKey("X-Proxy")
 	XForwardedFor = http.CanonicalHeaderKey("X-Forwarded-For")
+	XRequestID    = http.CanonicalHeaderKey("X-Request-ID")
+
+	XForwardedProto = http.CanonicalHeaderKey("X-Forwarded-Proto")
+	XForwardedHost  = http.CanonicalHeaderKey("X-Forwarded-Host")
+	Forwarded       = http.CanonicalHeaderKey("Forwarded")
 )
 
 var (
@@ -26,13 +36,40 @@ type HTTPProxy struct {
 	hostMap map[string]*httputil.ReverseProxy
 	lb      balancers.Balancer
 	alive   map[string]bool
+	mode    string
+
+	tlsConfig *tls.Config
+	tlsHosts  map[string]bool
+	poolStats map[string]*PoolStats
+
+	// upgraded connections are balanced and counted apart from requests
+	upgradeLB   balancers.Balancer
+	upgradeMode string
+	upgrade     UpgradeConfig
+	tunnels     *tunnels
+
+	grpcHealthCheck   bool
+	grpcHealthService string
+
+	errorPages *ErrorPages
 }
 
 // NewHTTPProxy create  new reverse proxy with url and balancer algorithm
-func NewHTTPProxy(targetHosts []string, algorithm string) (*HTTPProxy, error) {
+func NewHTTPProxy(targetHosts []string, algorithm string, opts ...Option) (*HTTPProxy, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.errorPages == nil {
+		o.errorPages = defaultErrorPages
+	}
+
 	hosts := make([]string, 0)
 	hostMap := make(map[string]*httputil.ReverseProxy)
 	alive := make(map[string]bool)
+	tlsHosts := make(map[string]bool)
+	poolStats := make(map[string]*PoolStats)
 
 	for _, targetHost := range targetHosts {
 		url, err := url.Parse(targetHost)
@@ -40,16 +77,22 @@ func NewHTTPProxy(targetHosts []string, algorithm string) (*HTTPProxy, error) {
 			return nil, err
 		}
 		proxy := httputil.NewSingleHostReverseProxy(url)
+		host := GetHost(url)
+		poolStats[host] = &PoolStats{}
+		proxy.Transport = newTransport(o, url.Scheme, poolStats[host])
 
-		originDirector := proxy.Director
-		proxy.Director = func(req *http.Request) {
-			originDirector(req)
-			req.Header.Set(XProxy, ReverseProxy)
-			req.Header.Set(XRealIP, GetIP(req))
+		proxy.Director = newDirector(o, proxy.Director)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if info := GetRequestInfo(resp.Request.Context()); info != nil {
+				info.UpstreamLatency = time.Since(info.upstreamStart)
+			}
+			o.headers.modifyResponse(resp)
+			return nil
 		}
+		proxy.ErrorHandler = errorHandler(o.errorPages)
 
-		host := GetHost(url)
 		alive[host] = true
+		tlsHosts[host] = url.Scheme == "https"
 		hostMap[host] = proxy
 		hosts = append(hosts, host)
 	}
@@ -58,32 +101,144 @@ func NewHTTPProxy(targetHosts []string, algorithm string) (*HTTPProxy, error) {
 	if err != nil {
 		return nil, err
 	}
+	upgradeMode := algorithm
+	if len(o.upgrade.BalanceMode) != 0 {
+		upgradeMode = o.upgrade.BalanceMode
+	}
+	// the balancers own their slice of hosts
+	upgradeLB, err := balancers.Build(upgradeMode, append([]string(nil), hosts...))
+	if err != nil {
+		return nil, err
+	}
 
 	return &HTTPProxy{
 		hostMap: hostMap,
 		lb:      lb,
 		alive:   alive,
+		mode:    algorithm,
+
+		tlsConfig: o.tlsConfig,
+		tlsHosts:  tlsHosts,
+		poolStats: poolStats,
+
+		upgradeLB:   upgradeLB,
+		upgradeMode: upgradeMode,
+		upgrade:     o.upgrade,
+		tunnels:     &tunnels{conns: make(map[string]map[*tunnelConn]struct{})},
+
+		grpcHealthCheck:   o.grpcHealthCheck,
+		grpcHealthService: o.grpcHealthService,
+
+		errorPages: o.errorPages,
 	}, nil
 }
 
+// newDirector returns the director of the upstream requests of a location,
+// `originDirector` sends them to the backend
+func newDirector(o *options, originDirector func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		clientIP, proto, host := GetIP(req), GetProto(req), GetForwardedHost(req)
+		o.rewrite.rewritePath(req.URL)
+		originDirector(req)
+		o.rewrite.rewriteHost(req)
+		// forwarding headers of untrusted peers are spoofed, the reverse proxy
+		// appends the peer to a fresh `X-Forwarded-For`
+		if !IsTrustedProxy(remoteIP(req)) {
+			req.Header.Del(XForwardedFor)
+			req.Header.Del(Forwarded)
+		}
+		req.Header.Set(XProxy, ReverseProxy)
+		req.Header.Set(XRealIP, clientIP)
+		req.Header.Set(XForwardedProto, proto)
+		req.Header.Set(XForwardedHost, host)
+		if info := GetRequestInfo(req.Context()); info != nil && len(info.ID) != 0 {
+			req.Header.Set(XRequestID, info.ID)
+		}
+		injectTrace(req)
+		o.headers.Request.apply(req.Context(), req.Header)
+	}
+}
+
+// errorHandler reports the failure of a proxied request to the client, with
+// 504 on a timeout and 502 on a connection failure
+func errorHandler(pages *ErrorPages) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		logf(r, "proxy error: %s", err)
+		span := trace.SpanFromContext(r.Context())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		status := errorStatus(err)
+		if IsGRPC(r) {
+			code := grpccodes.Unavailable
+			if status == http.StatusRequestEntityTooLarge {
+				code = grpccodes.ResourceExhausted
+			} else if status == http.StatusGatewayTimeout {
+				code = grpccodes.DeadlineExceeded
+			}
+			writeGRPCError(w, code, err.Error())
+			return
+		}
+		pages.Write(w, r, status)
+	}
+}
+
 // ServeHTTP implements a proxy to the http server
 func (h *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("proxy causes panic :%s", err)
-			w.WriteHeader(http.StatusBadGateway)
-			_, _ = w.Write([]byte(err.(error).Error()))
+			// the response is aborted once it is started
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logf(r, "proxy causes panic :%v", err)
+			h.errorPages.Write(w, r, http.StatusInternalServerError)
 		}
 	}()
 
-	host, err := h.lb.Balance(GetIP(r))
+	lb, mode := h.lb, h.mode
+	upgrade := IsUpgrade(r)
+	if upgrade {
+		lb, mode = h.upgradeLB, h.upgradeMode
+	}
+
+	_, span := tracer().Start(r.Context(), "balance",
+		trace.WithAttributes(attrAlgorithm.String(mode)))
+	host, err := lb.Balance(GetIP(r))
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte(fmt.Sprintf("balance error: %s", err.Error())))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		if IsGRPC(r) {
+			writeGRPCError(w, grpccodes.Unavailable, fmt.Sprintf("balance error: %s", err.Error()))
+			return
+		}
+		logf(r, "balance error: %s", err)
+		// no host is alive
+		h.errorPages.Write(w, r, http.StatusServiceUnavailable)
 		return
 	}
+	span.SetAttributes(attrBackend.String(host))
+	span.End()
 
-	h.lb.Inc(host)
-	defer h.lb.Done(host)
-	h.hostMap[host].ServeHTTP(w, r)
+	retries := 0
+	if info := GetRequestInfo(r.Context()); info != nil {
+		info.Backend = host
+		info.Mode = mode
+		info.upstreamStart = time.Now()
+		retries = info.Retries
+	}
+
+	ctx := withHeaderVars(withClientAddr(r.Context(), r), r, host)
+	ctx, upstream := tracer().Start(ctx, "upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrBackend.String(host), attrAlgorithm.String(mode), attrRetries.Int(retries)))
+	defer upstream.End()
+
+	if upgrade {
+		w = &upgradeWriter{ResponseWriter: w, proxy: h, host: host}
+	}
+	lb.Inc(host)
+	defer lb.Done(host)
+	h.hostMap[host].ServeHTTP(w, r.WithContext(ctx))
 }
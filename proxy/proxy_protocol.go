@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyHeaderTimeout refers to the time allowed to receive the PROXY protocol header
+var ProxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	InvalidProxyHeaderError = errors.New("invalid proxy protocol header")
+)
+
+// proxyListener accepts connections starting with a PROXY protocol header
+type proxyListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener wraps the listener, the accepted connections must
+// send a PROXY protocol v1 or v2 header, its source becomes the remote address
+func NewProxyProtocolListener(l net.Listener) net.Listener {
+	return &proxyListener{l}
+}
+
+// Accept waits for the next connection
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// proxyConn reads the PROXY protocol header lazily, so that a slow client
+// does not block the accept loop
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		c.remote, c.err = ReadProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read reads data after the PROXY protocol header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the source address of the PROXY protocol header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header, it returns a nil
+// address for `UNKNOWN` and `LOCAL` connections
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix, proxyV1Prefix) {
+		return nil, InvalidProxyHeaderError
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the v1 header is at most 107 bytes long including the CRLF
+	line := make([]byte, 0, 107)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, InvalidProxyHeaderError
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, InvalidProxyHeaderError
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, InvalidProxyHeaderError
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, InvalidProxyHeaderError
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, InvalidProxyHeaderError
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections, such as health checks of the proxy itself, and
+	// PROXY connections are the only commands
+	switch header[12] & 0x0f {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, InvalidProxyHeaderError
+	}
+	// the families are unspecified, inet, inet6 and unix, the transports
+	// are unspecified, stream and dgram
+	if header[13]>>4 > 3 || header[13]&0x0f > 2 {
+		return nil, InvalidProxyHeaderError
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, InvalidProxyHeaderError
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, InvalidProxyHeaderError
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// unix sockets and unspecified families carry no usable address
+	return nil, nil
+}
+
+// v1Address formats the address for the family, IPv4 addresses are mapped to
+// IPv6 when the other address is IPv6
+func v1Address(ip net.IP, ipv4 bool) string {
+	if ip4 := ip.To4(); ip4 != nil && !ipv4 {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// WriteProxyHeader writes a PROXY protocol header of `version` 1 or 2
+func WriteProxyHeader(w io.Writer, version int, src, dst *net.TCPAddr) error {
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	ipv4 := src4 != nil && dst4 != nil
+
+	if version == 1 {
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, v1Address(src.IP, ipv4), v1Address(dst.IP, ipv4), src.Port, dst.Port)
+		return err
+	}
+
+	header := bytes.NewBuffer(nil)
+	header.Write(proxyV2Signature)
+	header.WriteByte(0x21)
+	if ipv4 {
+		header.Write([]byte{0x11, 0x00, 12})
+		header.Write(src4)
+		header.Write(dst4)
+	} else {
+		header.Write([]byte{0x21, 0x00, 36})
+		header.Write(src.IP.To16())
+		header.Write(dst.IP.To16())
+	}
+	_ = binary.Write(header, binary.BigEndian, uint16(src.Port))
+	_ = binary.Write(header, binary.BigEndian, uint16(dst.Port))
+	_, err := w.Write(header.Bytes())
+	return err
+}
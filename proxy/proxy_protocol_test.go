@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	cases := []struct {
+		name    string
+		version int
+		src     *net.TCPAddr
+		dst     *net.TCPAddr
+	}{
+		{
+			"v1-ipv4",
+			1,
+			&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+		},
+		{
+			"v1-ipv6",
+			1,
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 5000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+		},
+		{
+			"v1-mixed",
+			1,
+			&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+		},
+		{
+			"v2-ipv4",
+			2,
+			&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+		},
+		{
+			"v2-ipv6",
+			2,
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 5000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+		},
+		{
+			"v2-mixed",
+			2,
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 5000},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			assert.Nil(t, WriteProxyHeader(buf, c.version, c.src, c.dst))
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			r := bufio.NewReader(buf)
+			addr, err := ReadProxyHeader(r)
+			assert.Nil(t, err)
+			assert.Equal(t, c.src.String(), addr.String())
+			rest, _ := r.ReadString('\n')
+			assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+		})
+	}
+
+	// the addresses of a TCP6 header are IPv6
+	buf := &bytes.Buffer{}
+	assert.Nil(t, WriteProxyHeader(buf, 1, &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}))
+	assert.Equal(t, "PROXY TCP6 ::ffff:192.168.1.10 2001:db8::1 5000 80\r\n", buf.String())
+
+	_, err := ReadProxyHeader(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n")))
+	assert.Equal(t, InvalidProxyHeaderError, err)
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	cases := []struct {
+		name    string
+		command byte
+		family  byte
+		addr    string
+		err     error
+	}{
+		{"proxy", 0x21, 0x11, "192.168.1.10:5000", nil},
+		{"local", 0x20, 0x11, "", nil},
+		{"unspecified family", 0x21, 0x00, "", nil},
+		{"unknown command", 0x22, 0x11, "", InvalidProxyHeaderError},
+		{"unknown family", 0x21, 0x41, "", InvalidProxyHeaderError},
+		{"unknown transport", 0x21, 0x13, "", InvalidProxyHeaderError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+			buf.Write([]byte{c.command, c.family, 0x00, 12, 192, 168, 1, 10, 10, 0, 0, 1, 0x13, 0x88, 0x00, 0x50})
+
+			addr, err := ReadProxyHeader(bufio.NewReader(buf))
+			assert.Equal(t, c.err, err)
+			if len(c.addr) != 0 {
+				assert.Equal(t, c.addr, addr.String())
+			} else {
+				assert.Nil(t, addr)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &httptest.Server{
+		Listener: NewProxyProtocolListener(ln),
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.RemoteAddr))
+		})},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, _ = conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 80\r\nGET / HTTP/1.0\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Nil(t, err)
+	body := make([]byte, 64)
+	n, _ := resp.Body.Read(body)
+	assert.Equal(t, "203.0.113.7:4000", string(body[:n]))
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	backend := &httptest.Server{
+		Listener: NewProxyProtocolListener(ln),
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.RemoteAddr))
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin", WithProxyProtocol(2))
+	assert.Nil(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	w := httptest.NewRecorder()
+	httpProxy.ServeHTTP(w, req)
+	assert.Equal(t, "203.0.113.7:4000", w.Body.String())
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"go-balancer/helpers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPProxy_BodyLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+	handler := helpers.BodyLimitMiddleware(8, defaultErrorPages.Write)(httpProxy)
+
+	cases := []struct {
+		name    string
+		body    string
+		chunked bool
+		expect  int
+	}{
+		{"small", "1234", false, http.StatusOK},
+		{"announced", "123456789", false, http.StatusRequestEntityTooLarge},
+		{"chunked", "123456789", true, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+			if c.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, c.expect, w.Code)
+			// the body too large is rejected with the error page, announced or not
+			if c.expect == http.StatusRequestEntityTooLarge {
+				assert.Equal(t, "413 Request Entity Too Large: the request body is too large\n", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRequestIDLength bounds the length of a request ID accepted from a client
+const maxRequestIDLength = 128
+
+// NewRequestID generates a random request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether the request ID is printable and not too long
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware reuses the `X-Request-ID` of the client or generates
+// a new one, and returns it in the response
+func RequestIDMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, info := WithRequestInfo(r)
+			id := r.Header.Get(XRequestID)
+			if !validRequestID(id) {
+				id = NewRequestID()
+			}
+			info.ID = id
+			w.Header().Set(XRequestID, id)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// logf logs the message prefixed with the request ID of `r`
+func logf(r *http.Request, format string, v ...interface{}) {
+	if info := GetRequestInfo(r.Context()); info != nil && len(info.ID) != 0 {
+		log.Printf("[%s] %s", info.ID, fmt.Sprintf(format, v...))
+		return
+	}
+	log.Printf(format, v...)
+}
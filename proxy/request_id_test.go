@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(XRequestID)
+	}))
+	defer backend.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+	handler := RequestIDMiddleware()(httpProxy)
+
+	cases := []struct {
+		name     string
+		incoming string
+		reuse    bool
+	}{
+		{"reuse", "abc-123", true},
+		{"generate", "", false},
+		{"invalid", "bad id", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if len(c.incoming) != 0 {
+				req.Header.Set(XRequestID, c.incoming)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			id := w.Header().Get(XRequestID)
+			assert.Equal(t, id, received)
+			if c.reuse {
+				assert.Equal(t, c.incoming, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RequestInfo collects the details of how a request was proxied,
+// it is filled by HTTPProxy and read by the middlewares around it. Retries
+// stays 0 as the proxy does not retry yet.
+type RequestInfo struct {
+	ID      string
+	Backend string
+	// Group is the backend group of a location splitting its traffic
+	Group string
+	// Cache is the X-Cache status of a location with a cache
+	Cache           string
+	Mode            string
+	Retries         int
+	UpstreamLatency time.Duration
+	upstreamStart   time.Time
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo attaches an empty RequestInfo to the request
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	if info := GetRequestInfo(r.Context()); info != nil {
+		return r, info
+	}
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// GetRequestInfo returns the RequestInfo of the request, or nil
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// BackendHost refers to the host of the backend as the Host header of the upstream requests
+const BackendHost = "$backend"
+
+// RewriteConfig refers to the rewriting of the upstream requests of a location,
+// the path is rewritten with its original encoding and the query is kept
+type RewriteConfig struct {
+	// StripPrefix is removed from the path when it ends at a segment boundary
+	StripPrefix string
+	// Rules are applied in order to the path after the prefix is stripped
+	Rules []RewriteRule
+	// AddPrefix is prepended to the rewritten path
+	AddPrefix string
+	// Host overrides the Host header, BackendHost uses the host of the backend,
+	// empty keeps the host of the client request
+	Host string
+}
+
+// RewriteRule replaces the matches of Pattern with Replacement, which may
+// refer to the groups of the pattern such as `$1`
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// rewritePath rewrites the path of the url, it is not modified when the
+// rewritten path is not validly encoded
+func (c *RewriteConfig) rewritePath(u *url.URL) {
+	if len(c.StripPrefix) == 0 && len(c.Rules) == 0 && len(c.AddPrefix) == 0 {
+		return
+	}
+	path := u.EscapedPath()
+	if prefix := c.StripPrefix; len(prefix) != 0 && strings.HasPrefix(path, prefix) {
+		if rest := path[len(prefix):]; strings.HasSuffix(prefix, "/") || len(rest) == 0 || rest[0] == '/' {
+			path = rest
+		}
+	}
+	for _, rule := range c.Rules {
+		path = rule.Pattern.ReplaceAllString(path, rule.Replacement)
+	}
+	if len(c.AddPrefix) != 0 {
+		path = strings.TrimSuffix(c.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return
+	}
+	u.Path = unescaped
+	u.RawPath = ""
+	if u.EscapedPath() != path {
+		u.RawPath = path
+	}
+}
+
+// rewriteHost sets the Host header of the upstream request
+func (c *RewriteConfig) rewriteHost(req *http.Request) {
+	switch c.Host {
+	case "":
+	case BackendHost:
+		req.Host = req.URL.Host
+	default:
+		req.Host = c.Host
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPProxy_Rewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	cases := []struct {
+		name    string
+		target  string
+		rewrite RewriteConfig
+		expect  string
+	}{
+		{"none", "/api/a%2Fb?x=1", RewriteConfig{}, "client /api/a%2Fb?x=1"},
+		{"strip prefix", "/api/a%2Fb?x=1", RewriteConfig{StripPrefix: "/api"}, "client /a%2Fb?x=1"},
+		{"strip whole path", "/api", RewriteConfig{StripPrefix: "/api"}, "client /"},
+		{"strip segment only", "/apis/a", RewriteConfig{StripPrefix: "/api"}, "client /apis/a"},
+		{"add prefix", "/a?x=1", RewriteConfig{AddPrefix: "/v1/"}, "client /v1/a?x=1"},
+		{"strip and add", "/api/a", RewriteConfig{StripPrefix: "/api/", AddPrefix: "/internal"}, "client /internal/a"},
+		{"regex", "/users/42/posts?page=2", RewriteConfig{Rules: []RewriteRule{
+			{Pattern: regexp.MustCompile(`^/users/([0-9]+)/posts$`), Replacement: "/posts/by/$1"},
+		}}, "client /posts/by/42?page=2"},
+		{"host", "/a", RewriteConfig{Host: "internal.example.com"}, "internal.example.com /a"},
+		{"backend host", "/a", RewriteConfig{Host: BackendHost}, u.Host + " /a"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin", WithRewrite(c.rewrite))
+			assert.Nil(t, err)
+			req := httptest.NewRequest(http.MethodGet, c.target, nil)
+			req.Host = "client"
+			w := httptest.NewRecorder()
+			httpProxy.ServeHTTP(w, req)
+			assert.Equal(t, c.expect, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var NoGroupError = errors.New("no backend group receives traffic")
+
+// SplitRule sends the requests carrying a header or a cookie with Value,
+// or with any value for an empty one, to Group
+type SplitRule struct {
+	Header string
+	Cookie string
+	Value  string
+	Group  string
+}
+
+// SplitConfig refers to the traffic split between the backend groups of a
+// location, the requests matching none of the rules are shared by weight
+type SplitConfig struct {
+	Rules   []SplitRule
+	Weights map[string]uint
+}
+
+// SplitProxy refers to a location with several backend groups, such as
+// stable and canary, each group balances its requests with its own HTTPProxy
+type SplitProxy struct {
+	sync.RWMutex
+	groups map[string]*HTTPProxy
+	// order lists the groups for a deterministic weighted choice
+	order  []string
+	config SplitConfig
+	total  uint
+	rnd    *rand.Rand
+}
+
+// NewSplitProxy create new SplitProxy with the proxies of the groups listed in order
+func NewSplitProxy(groups map[string]*HTTPProxy, order []string, config SplitConfig) (*SplitProxy, error) {
+	s := &SplitProxy{
+		groups: groups,
+		order:  order,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if err := s.Update(config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update replaces the rules and the weights, so that the traffic can be
+// shifted progressively between the groups without a restart
+func (s *SplitProxy) Update(config SplitConfig) error {
+	total, err := s.validate(config)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.config = config
+	s.total = total
+	return nil
+}
+
+// Validate returns the error Update would return for the config, without applying it
+func (s *SplitProxy) Validate(config SplitConfig) error {
+	_, err := s.validate(config)
+	return err
+}
+
+// validate returns the total weight of the config
+func (s *SplitProxy) validate(config SplitConfig) (uint, error) {
+	var total uint
+	for group, weight := range config.Weights {
+		if _, ok := s.groups[group]; !ok {
+			return 0, fmt.Errorf("unknown backend group \"%s\"", group)
+		}
+		total += weight
+	}
+	for _, rule := range config.Rules {
+		if _, ok := s.groups[rule.Group]; !ok {
+			return 0, fmt.Errorf("unknown backend group \"%s\"", rule.Group)
+		}
+	}
+	if total == 0 {
+		return 0, NoGroupError
+	}
+	return total, nil
+}
+
+// Weights returns the current weights of the groups
+func (s *SplitProxy) Weights() map[string]uint {
+	s.RLock()
+	defer s.RUnlock()
+	weights := make(map[string]uint, len(s.config.Weights))
+	for group, weight := range s.config.Weights {
+		weights[group] = weight
+	}
+	return weights
+}
+
+// Group returns the proxy of the group
+func (s *SplitProxy) Group(name string) *HTTPProxy {
+	return s.groups[name]
+}
+
+// choose returns the group of the request
+func (s *SplitProxy) choose(r *http.Request) string {
+	s.Lock()
+	defer s.Unlock()
+	for _, rule := range s.config.Rules {
+		if matchSplitRule(r, rule) {
+			return rule.Group
+		}
+	}
+	n := uint(s.rnd.Int63n(int64(s.total)))
+	for _, group := range s.order {
+		weight := s.config.Weights[group]
+		if n < weight {
+			return group
+		}
+		n -= weight
+	}
+	return s.order[len(s.order)-1]
+}
+
+func matchSplitRule(r *http.Request, rule SplitRule) bool {
+	var values []string
+	if len(rule.Header) != 0 {
+		values = r.Header.Values(rule.Header)
+	} else if cookie, err := r.Cookie(rule.Cookie); err == nil {
+		values = []string{cookie.Value}
+	}
+	if len(rule.Value) == 0 {
+		return len(values) != 0
+	}
+	for _, v := range values {
+		if v == rule.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP implements a proxy to the group chosen for the request
+func (s *SplitProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	group := s.choose(r)
+	if info := GetRequestInfo(r.Context()); info != nil {
+		info.Group = group
+	}
+	s.groups[group].ServeHTTP(w, r)
+}
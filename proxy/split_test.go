@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func namedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name))
+	}))
+}
+
+func newSplitProxy(t *testing.T, config SplitConfig) *SplitProxy {
+	groups := make(map[string]*HTTPProxy)
+	for _, name := range []string{"stable", "canary"} {
+		backend := namedBackend(name)
+		t.Cleanup(backend.Close)
+		httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+		assert.Nil(t, err)
+		groups[name] = httpProxy
+	}
+	s, err := NewSplitProxy(groups, []string{"stable", "canary"}, config)
+	assert.Nil(t, err)
+	return s
+}
+
+// split counts the groups serving n requests
+func split(s *SplitProxy, n int, prepare func(*http.Request)) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if prepare != nil {
+			prepare(req)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		counts[w.Body.String()]++
+	}
+	return counts
+}
+
+func TestSplitProxy(t *testing.T) {
+	s := newSplitProxy(t, SplitConfig{
+		Rules: []SplitRule{
+			{Header: "X-Canary", Value: "1", Group: "canary"},
+			{Cookie: "canary", Group: "canary"},
+		},
+		Weights: map[string]uint{"stable": 100, "canary": 0},
+	})
+
+	cases := []struct {
+		name    string
+		prepare func(*http.Request)
+		expect  map[string]int
+	}{
+		{"weight", nil, map[string]int{"stable": 20}},
+		{"header", func(r *http.Request) { r.Header.Set("X-Canary", "1") }, map[string]int{"canary": 20}},
+		{"header value", func(r *http.Request) { r.Header.Set("X-Canary", "0") }, map[string]int{"stable": 20}},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "canary", Value: "yes"}) }, map[string]int{"canary": 20}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, split(s, 20, c.prepare))
+		})
+	}
+}
+
+func TestSplitProxy_Update(t *testing.T) {
+	s := newSplitProxy(t, SplitConfig{Weights: map[string]uint{"stable": 90, "canary": 10}})
+	counts := split(s, 1000, nil)
+	assert.InDelta(t, 100, counts["canary"], 50)
+
+	// the traffic is shifted to the canary
+	assert.Nil(t, s.Update(SplitConfig{Weights: map[string]uint{"stable": 0, "canary": 1}}))
+	assert.Equal(t, map[string]int{"canary": 20}, split(s, 20, nil))
+
+	assert.NotNil(t, s.Update(SplitConfig{Weights: map[string]uint{"beta": 1}}))
+	assert.Equal(t, NoGroupError, s.Update(SplitConfig{Weights: map[string]uint{"stable": 0}}))
+	assert.Equal(t, map[string]uint{"stable": 0, "canary": 1}, s.Weights())
+
+	// a config is validated without being applied
+	assert.Nil(t, s.Validate(SplitConfig{Weights: map[string]uint{"stable": 1}}))
+	assert.Equal(t, NoGroupError, s.Validate(SplitConfig{Weights: map[string]uint{"canary": 0}}))
+	assert.Equal(t, map[string]uint{"stable": 0, "canary": 1}, s.Weights())
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TCPIdleTimeout refers to the connection idle timeout used when none is configured
+var TCPIdleTimeout = 10 * time.Minute
+
+var TCPProxyClosedError = errors.New("tcp proxy closed")
+
+// TCPConfig refers to the connections of a tcp proxy
+type TCPConfig struct {
+	// IdleTimeout closes a connection without bytes in either direction
+	IdleTimeout time.Duration
+}
+
+// TCPProxy refers to a layer 4 proxy in the balancer, the bytes of each
+// client connection are spliced to a host chosen by the balancer
+type TCPProxy struct {
+	*layer4
+
+	proxyProtocol int
+	dialer        *net.Dialer
+	idleTimeout   time.Duration
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// NewTCPProxy create new tcp proxy with the `host:port`, or `tcp://host:port`,
+// of the backends and balancer algorithm
+func NewTCPProxy(targetHosts []string, algorithm string, opts ...Option) (*TCPProxy, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	backends, err := newLayer4(targetHosts, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   ConnectionTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if o.transport.DialTimeout > 0 {
+		dialer.Timeout = o.transport.DialTimeout
+	}
+	if o.transport.KeepAlive > 0 {
+		dialer.KeepAlive = o.transport.KeepAlive
+	}
+
+	idleTimeout := o.tcp.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = TCPIdleTimeout
+	}
+
+	return &TCPProxy{
+		layer4: backends,
+
+		proxyProtocol: o.proxyProtocol,
+		dialer:        dialer,
+		idleTimeout:   idleTimeout,
+
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve accepts the connections of the listener and proxies each of them
+// in its own goroutine, until the proxy is shut down
+func (t *TCPProxy) Serve(ln net.Listener) error {
+	if !t.track(ln, true) {
+		return TCPProxyClosedError
+	}
+	defer t.track(ln, false)
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return TCPProxyClosedError
+			}
+			if temporaryAcceptError(err) {
+				// back off on temporary errors such as too many open files
+				if delay = 2*delay + 5*time.Millisecond; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go t.handle(conn)
+	}
+}
+
+// temporaryAcceptError reports whether the listener may accept connections
+// again, such as once file descriptors are released or after an aborted connection
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM)
+}
+
+// track adds or removes the listener, it reports false once the proxy is closed
+func (t *TCPProxy) track(ln net.Listener, add bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if add {
+		if t.closed {
+			return false
+		}
+		t.listeners[ln] = struct{}{}
+	} else {
+		delete(t.listeners, ln)
+	}
+	return true
+}
+
+func (t *TCPProxy) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// handle splices the client connection to a backend, the host is counted as
+// loaded for the whole lifetime of the connection
+func (t *TCPProxy) handle(conn net.Conn) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		conn.Close()
+		t.wg.Done()
+	}()
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	host, err := t.lb.Balance(clientIP)
+	if err != nil {
+		log.Printf("tcp balance error: %s", err)
+		return
+	}
+	t.lb.Inc(host)
+	defer t.lb.Done(host)
+
+	upstream, err := t.dialer.Dial("tcp", host)
+	if err != nil {
+		log.Printf("tcp proxy error: %s", err)
+		return
+	}
+	defer upstream.Close()
+	if t.proxyProtocol != 0 {
+		src, _ := conn.RemoteAddr().(*net.TCPAddr)
+		dst, _ := upstream.RemoteAddr().(*net.TCPAddr)
+		if src == nil {
+			src, _ = upstream.LocalAddr().(*net.TCPAddr)
+		}
+		if err := WriteProxyHeader(upstream, t.proxyProtocol, src, dst); err != nil {
+			log.Printf("tcp proxy error: %s", err)
+			return
+		}
+	}
+
+	s := &splicer{idle: t.idleTimeout}
+	s.touch()
+	done := make(chan struct{}, 2)
+	go s.splice(upstream, conn, done)
+	go s.splice(conn, upstream, done)
+	<-done
+	<-done
+}
+
+// splicer copies the bytes of a connection in both directions until it is idle
+type splicer struct {
+	idle time.Duration
+	// lastActive is the time of the latest bytes in unix nanoseconds
+	lastActive int64
+}
+
+func (s *splicer) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *splicer) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// splice copies src to dst, then half-closes dst so that the peer sees the
+// end of stream. Both connections are closed once idle in both directions.
+func (s *splicer) splice(dst, src net.Conn, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	buf := make([]byte, 32*1024)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(s.idle - s.idleFor()))
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.touch()
+			_ = dst.SetWriteDeadline(time.Now().Add(s.idle))
+			if _, err := dst.Write(buf[:n]); err != nil {
+				src.Close()
+				dst.Close()
+				return
+			}
+		}
+		if err == nil {
+			continue
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			if s.idleFor() < s.idle {
+				// the other direction carried bytes in the meantime
+				continue
+			}
+			src.Close()
+			dst.Close()
+			return
+		}
+		if err != io.EOF || !closeWrite(dst) {
+			dst.Close()
+		}
+		return
+	}
+}
+
+// closeWrite half-closes the connection, or the one under its tls and PROXY
+// protocol layers, it reports false when none of them supports it
+func closeWrite(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// Shutdown closes the listeners and waits for the open connections to end,
+// the remaining ones are closed when the context is done
+func (t *TCPProxy) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closed = true
+	for ln := range t.listeners {
+		ln.Close()
+	}
+	t.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
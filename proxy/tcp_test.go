@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoTCPServer writes its name and echoes the bytes until the end of stream
+func echoTCPServer(t *testing.T, name string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte(name))
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTCPProxy(t *testing.T) {
+	a, b := echoTCPServer(t, "a"), echoTCPServer(t, "b")
+	defer a.Close()
+	defer b.Close()
+
+	cases := []struct {
+		name  string
+		hosts []string
+	}{
+		{"host:port", []string{a.Addr().String(), b.Addr().String()}},
+		{"tcp://host:port", []string{"tcp://" + a.Addr().String(), "tcp://" + b.Addr().String()}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tcpProxy, err := NewTCPProxy(c.hosts, "least-load")
+			assert.Nil(t, err)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Nil(t, err)
+			served := make(chan error, 1)
+			go func() { served <- tcpProxy.Serve(ln) }()
+
+			// the first connection loads its host until it is closed,
+			// so the second one goes to the other host
+			names := make(map[string]bool)
+			conns := make([]net.Conn, 0)
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				assert.Nil(t, err)
+				name := make([]byte, 1)
+				_, err = io.ReadFull(conn, name)
+				assert.Nil(t, err)
+				names[string(name)] = true
+				conns = append(conns, conn)
+			}
+			assert.Equal(t, map[string]bool{"a": true, "b": true}, names)
+
+			// the end of stream is forwarded to the backend and back
+			_, _ = conns[0].Write([]byte("ping"))
+			_ = conns[0].(*net.TCPConn).CloseWrite()
+			reply, err := io.ReadAll(conns[0])
+			assert.Nil(t, err)
+			assert.Equal(t, "ping", string(reply))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			assert.Equal(t, context.DeadlineExceeded, tcpProxy.Shutdown(ctx))
+			assert.Equal(t, TCPProxyClosedError, <-served)
+			_, err = io.ReadAll(conns[1])
+			assert.Nil(t, err)
+			conns[1].Close()
+		})
+	}
+}
+
+func TestNewTCPProxy_InvalidHost(t *testing.T) {
+	_, err := NewTCPProxy([]string{"127.0.0.1"}, "round-robin")
+	assert.NotNil(t, err)
+}
+
+func TestTCPProxy_IdleTimeout(t *testing.T) {
+	a := echoTCPServer(t, "a")
+	defer a.Close()
+	tcpProxy, err := NewTCPProxy([]string{a.Addr().String()}, "round-robin",
+		WithTCP(TCPConfig{IdleTimeout: 200 * time.Millisecond}))
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = tcpProxy.Serve(ln) }()
+	defer func() { _ = tcpProxy.Shutdown(context.Background()) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+
+	// the bytes of the client keep the connection open past the timeout
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err = conn.Write([]byte("x"))
+		assert.Nil(t, err)
+		_, err = io.ReadFull(conn, reply)
+		assert.Nil(t, err)
+	}
+
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(reply)
+	assert.Equal(t, io.EOF, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	assert.True(t, closeWrite(&proxyConn{Conn: conn}))
+	assert.False(t, closeWrite(client))
+}
+
+func TestTemporaryAcceptError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{"too many open files", &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}, true},
+		{"file table overflow", &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ENFILE)}, true},
+		{"connection aborted", &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ECONNABORTED)}, true},
+		{"closed", net.ErrClosed, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, temporaryAcceptError(c.err))
+		})
+	}
+}
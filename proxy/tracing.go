@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"go-balancer/helpers"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name of the spans created by the balancer
+const TracerName = "go-balancer/proxy"
+
+var (
+	attrBackend   = attribute.Key("balancer.backend")
+	attrAlgorithm = attribute.Key("balancer.algorithm")
+	attrRetries   = attribute.Key("balancer.retries")
+)
+
+// InitTracing installs a global tracer provider exporting spans with OTLP
+// over http to `endpoint`, and the W3C trace context propagator.
+// The returned function flushes and stops the exporter.
+func InitTracing(endpoint string, insecure bool, serviceName string, sampleRatio float64) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// TracingMiddleware extracts the trace context of the client and wraps
+// the request in a server span
+func TracingMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer().Start(ctx, r.Method+" "+r.URL.Path,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.URLPath(r.URL.Path),
+					semconv.ClientAddress(GetIP(r)),
+				))
+			defer span.End()
+
+			rec := helpers.NewResponseRecorder(w)
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status))
+			if rec.Status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.Status))
+			}
+		})
+	}
+}
+
+// injectTrace writes the trace context of `req` to its headers
+func injectTrace(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	// a stand-in for the OTLP collector
+	var exported int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			atomic.AddInt32(&exported, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer backend.Close()
+
+	// InitTracing replaces the global provider and propagator of the other tests
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	u, _ := url.Parse(collector.URL)
+	shutdown, err := InitTracing(u.Host, true, "test", 1)
+	assert.Nil(t, err)
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+	handler := TracingMiddleware()(httpProxy)
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Traceparent", incoming)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the backend continues the trace of the client with a new parent span
+	parts := strings.Split(traceparent, "-")
+	assert.Len(t, parts, 4)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", parts[1])
+	assert.NotEqual(t, "00f067aa0ba902b7", parts[2])
+
+	assert.Nil(t, shutdown(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exported))
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type clientAddrKey struct{}
+
+// withClientAddr stores the address of the client in the context,
+// it is the source address of the PROXY protocol header
+func withClientAddr(ctx context.Context, r *http.Request) context.Context {
+	_, port, _ := net.SplitHostPort(r.RemoteAddr)
+	p, _ := strconv.Atoi(port)
+	addr := &net.TCPAddr{IP: net.ParseIP(GetIP(r)), Port: p}
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// TransportConfig tunes the connections of a HTTPProxy to its backends,
+// zero values keep the defaults of http.DefaultTransport
+type TransportConfig struct {
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	KeepAlive             time.Duration
+	DisableHTTP2          bool
+	DisableCompression    bool
+}
+
+// PoolStats refers to the connection pool statistics of a backend
+type PoolStats struct {
+	// Open is the number of connections currently open to the backend
+	Open int64 `json:"open"`
+	// Dials is the number of connections opened since the start
+	Dials int64 `json:"dials"`
+	// DialErrors is the number of connections that could not be opened
+	DialErrors int64 `json:"dial_errors"`
+	// Requests is the number of requests sent to the backend
+	Requests int64 `json:"requests"`
+	// Reused is the number of requests sent on a pooled connection
+	Reused int64 `json:"reused"`
+	// Active is the number of requests in flight, until their response body is closed
+	Active int64 `json:"active"`
+	// Upgraded is the number of upgraded connections currently open, such as WebSockets
+	Upgraded int64 `json:"upgraded"`
+}
+
+// snapshot reads the counters atomically
+func (s *PoolStats) snapshot() PoolStats {
+	return PoolStats{
+		Open:       atomic.LoadInt64(&s.Open),
+		Dials:      atomic.LoadInt64(&s.Dials),
+		DialErrors: atomic.LoadInt64(&s.DialErrors),
+		Requests:   atomic.LoadInt64(&s.Requests),
+		Reused:     atomic.LoadInt64(&s.Reused),
+		Active:     atomic.LoadInt64(&s.Active),
+		Upgraded:   atomic.LoadInt64(&s.Upgraded),
+	}
+}
+
+// countedConn decrements the open connections of the pool when closed
+type countedConn struct {
+	net.Conn
+	stats *PoolStats
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.Open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// statsTransport counts the requests to a backend and the reuse of its connections
+type statsTransport struct {
+	*http.Transport
+	stats *PoolStats
+}
+
+// RoundTrip counts the request as active until its response body is closed
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.stats.Requests, 1)
+	atomic.AddInt64(&t.stats.Active, 1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&t.stats.Reused, 1)
+			}
+		},
+	}
+	resp, err := t.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		atomic.AddInt64(&t.stats.Active, -1)
+		return nil, err
+	}
+	body := &countedBody{ReadCloser: resp.Body, stats: t.stats}
+	// the body of an upgraded connection is written to as well
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &countedReadWriteBody{countedBody: body, writer: rw}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// countedBody decrements the active requests of the pool when closed
+type countedBody struct {
+	io.ReadCloser
+	stats *PoolStats
+	once  sync.Once
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(func() {
+		atomic.AddInt64(&b.stats.Active, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// countedReadWriteBody is the countedBody of an upgraded connection
+type countedReadWriteBody struct {
+	*countedBody
+	writer io.Writer
+}
+
+func (b *countedReadWriteBody) Write(p []byte) (int, error) {
+	return b.writer.Write(p)
+}
+
+// newTransport creates the transport to a backend according to the options
+func newTransport(o *options, scheme string, stats *PoolStats) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	c := o.transport
+	if c.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < c.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = c.MaxIdleConnsPerHost
+		}
+	}
+	if c.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = c.MaxConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = c.IdleConnTimeout
+	}
+	if c.DialTimeout > 0 {
+		dialer.Timeout = c.DialTimeout
+	}
+	if c.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	}
+	if c.KeepAlive > 0 {
+		dialer.KeepAlive = c.KeepAlive
+	}
+	if c.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	transport.DisableCompression = c.DisableCompression
+	if o.tlsConfig != nil {
+		transport.TLSClientConfig = o.tlsConfig.Clone()
+	}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt64(&stats.DialErrors, 1)
+			return nil, err
+		}
+		if o.proxyProtocol != 0 {
+			src, _ := ctx.Value(clientAddrKey{}).(*net.TCPAddr)
+			dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+			if src == nil || src.IP == nil || dst == nil {
+				src, _ = conn.LocalAddr().(*net.TCPAddr)
+			}
+			if err := WriteProxyHeader(conn, o.proxyProtocol, src, dst); err != nil {
+				conn.Close()
+				atomic.AddInt64(&stats.DialErrors, 1)
+				return nil, err
+			}
+		}
+		atomic.AddInt64(&stats.Dials, 1)
+		atomic.AddInt64(&stats.Open, 1)
+		return &countedConn{Conn: conn, stats: stats}, nil
+	}
+	if o.grpc {
+		transport.Protocols = grpcProtocols(scheme)
+	}
+	if o.proxyProtocol != 0 {
+		// the header carries the client of the first request, so connections are not reused
+		transport.DisableKeepAlives = true
+		transport.ForceAttemptHTTP2 = false
+	}
+	return &statsTransport{Transport: transport, stats: stats}
+}
+
+// PoolStats returns the connection pool statistics of each backend
+func (h *HTTPProxy) PoolStats() map[string]PoolStats {
+	stats := make(map[string]PoolStats, len(h.poolStats))
+	for host, s := range h.poolStats {
+		stats[host] = s.snapshot()
+	}
+	return stats
+}
+
+// PoolStatsHandler reports the connection pool statistics of the backends
+// of each location as JSON
+func PoolStatsHandler(proxies map[string]*HTTPProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := make(map[string]map[string]PoolStats, len(proxies))
+		for pattern, h := range proxies {
+			reply[pattern] = h.PoolStats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(reply)
+	})
+}
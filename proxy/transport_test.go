@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"go-balancer/helpers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer backend.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}
+	assert.Nil(t, os.WriteFile(ca, pem.EncodeToMemory(block), 0600))
+	// the test certificate is issued for example.com
+	trusted, err := helpers.NewClientTLSConfig(ca, "", "", "example.com", false)
+	assert.Nil(t, err)
+	u, _ := url.Parse(backend.URL)
+
+	cases := []struct {
+		name   string
+		opts   []Option
+		status int
+		alive  bool
+	}{
+		{"system roots", nil, http.StatusBadGateway, false},
+		{"private ca", []Option{WithUpstreamTLS(trusted)}, http.StatusOK, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin", c.opts...)
+			assert.Nil(t, err)
+			w := httptest.NewRecorder()
+			httpProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, c.status, w.Code)
+			if c.alive {
+				assert.Equal(t, true, httpProxy.isBackendAlive(u.Host))
+			}
+		})
+	}
+
+	assert.Equal(t, false, IsBackendAliveTLS(u.Host, &tls.Config{}))
+}
+
+func TestPoolStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin",
+		WithTransport(TransportConfig{MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Minute}))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		httpProxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	stats := httpProxy.PoolStats()[u.Host]
+	assert.Equal(t, int64(3), stats.Requests)
+	assert.Equal(t, int64(1), stats.Dials)
+	assert.Equal(t, int64(2), stats.Reused)
+	assert.Equal(t, int64(1), stats.Open)
+	assert.Equal(t, int64(0), stats.Active)
+}
+
+func TestPoolStats_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("end"))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin")
+	assert.Nil(t, err)
+	front := httptest.NewServer(httpProxy)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	assert.Nil(t, err)
+	start := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, start)
+	assert.Nil(t, err)
+	assert.Equal(t, "start", string(start))
+
+	// the request is active until its response body is closed
+	assert.Equal(t, int64(1), httpProxy.PoolStats()[u.Host].Active)
+	close(release)
+	end, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "end", string(end))
+	assert.Eventually(t, func() bool { return httpProxy.PoolStats()[u.Host].Active == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPSessionTimeout refers to the session idle timeout used when none is configured
+var UDPSessionTimeout = 30 * time.Second
+
+var UDPProxyClosedError = errors.New("udp proxy closed")
+
+// udpDropLogInterval bounds the logs of the datagrams dropped by a full session table
+const udpDropLogInterval = time.Minute
+
+// maxDatagramSize is the largest payload of a udp datagram
+const maxDatagramSize = 64 * 1024
+
+// UDPConfig refers to the sessions of a udp proxy
+type UDPConfig struct {
+	// IdleTimeout ends a session without datagrams in either direction
+	IdleTimeout time.Duration
+	// MaxSessions bounds the session table, the datagrams of new clients are
+	// dropped once it is full, 0 refers to no limit
+	MaxSessions int
+}
+
+// UDPProxy refers to a layer 4 proxy of datagrams in the balancer, the
+// datagrams of a client are sent to the same host for the lifetime of its session
+type UDPProxy struct {
+	*layer4
+
+	config UDPConfig
+	dialer *net.Dialer
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.PacketConn]struct{}
+	sessions map[string]*udpSession
+	dropped  int64
+	// droppedLogged is the time of the latest log of dropped datagrams in unix nanoseconds
+	droppedLogged int64
+}
+
+// udpSession relays the datagrams between a client of a listener and a host
+type udpSession struct {
+	key      string
+	client   net.Addr
+	conn     net.PacketConn
+	upstream net.Conn
+	host     string
+	// lastActive is the time of the latest datagram in unix nanoseconds
+	lastActive int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// NewUDPProxy create new udp proxy with the `host:port`, or `udp://host:port`,
+// of the backends and balancer algorithm
+func NewUDPProxy(targetHosts []string, algorithm string, opts ...Option) (*UDPProxy, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	backends, err := newLayer4(targetHosts, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	config := o.udp
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = UDPSessionTimeout
+	}
+
+	return &UDPProxy{
+		layer4: backends,
+
+		config: config,
+		dialer: &net.Dialer{Timeout: ConnectionTimeout},
+
+		conns:    make(map[net.PacketConn]struct{}),
+		sessions: make(map[string]*udpSession),
+	}, nil
+}
+
+// Serve reads the datagrams of the listener and sends each of them through
+// the session of its client, until the proxy is shut down
+func (u *UDPProxy) Serve(conn net.PacketConn) error {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return UDPProxyClosedError
+	}
+	u.conns[conn] = struct{}{}
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.conns, conn)
+		u.mu.Unlock()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if u.isClosed() {
+				return UDPProxyClosedError
+			}
+			return err
+		}
+		s := u.session(conn, client)
+		if s == nil {
+			continue
+		}
+		s.touch()
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			log.Printf("udp proxy error: %s", err)
+		}
+	}
+}
+
+func (u *UDPProxy) isClosed() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.closed
+}
+
+// session returns the session of the client on the listener, a new session
+// is balanced to a host unless the session table is full
+func (u *UDPProxy) session(conn net.PacketConn, client net.Addr) *udpSession {
+	key := conn.LocalAddr().String() + "|" + client.String()
+
+	u.mu.Lock()
+	s, ok := u.sessions[key]
+	full := u.config.MaxSessions > 0 && len(u.sessions) >= u.config.MaxSessions
+	closed := u.closed
+	u.mu.Unlock()
+	if ok {
+		return s
+	}
+	if closed {
+		return nil
+	}
+	if full {
+		u.drop()
+		return nil
+	}
+
+	// the host is balanced and dialed without holding the lock of the
+	// sessions, the datagrams of the other clients keep flowing meanwhile
+	clientIP, _, _ := net.SplitHostPort(client.String())
+	host, err := u.lb.Balance(clientIP)
+	if err != nil {
+		log.Printf("udp balance error: %s", err)
+		return nil
+	}
+	upstream, err := u.dialer.Dial("udp", host)
+	if err != nil {
+		log.Printf("udp proxy error: %s", err)
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if s, ok := u.sessions[key]; ok {
+		upstream.Close()
+		return s
+	}
+	if u.closed || (u.config.MaxSessions > 0 && len(u.sessions) >= u.config.MaxSessions) {
+		upstream.Close()
+		if !u.closed {
+			u.drop()
+		}
+		return nil
+	}
+	s = &udpSession{
+		key:      key,
+		client:   client,
+		conn:     conn,
+		upstream: upstream,
+		host:     host,
+	}
+	s.touch()
+	u.lb.Inc(host)
+	u.sessions[key] = s
+	go u.relay(s)
+	return s
+}
+
+// drop counts a datagram of a new client dropped while the session table is
+// full, it is logged at most once per udpDropLogInterval
+func (u *UDPProxy) drop() {
+	dropped := atomic.AddInt64(&u.dropped, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&u.droppedLogged)
+	if now-last >= int64(udpDropLogInterval) && atomic.CompareAndSwapInt64(&u.droppedLogged, last, now) {
+		log.Printf("udp session table is full, %d datagrams of new clients dropped.", dropped)
+	}
+}
+
+// Dropped returns the number of datagrams of new clients dropped while the
+// session table was full
+func (u *UDPProxy) Dropped() int64 {
+	return atomic.LoadInt64(&u.dropped)
+}
+
+// relay sends the datagrams of the host back to the client until the session is idle
+func (u *UDPProxy) relay(s *udpSession) {
+	defer u.end(s)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		_ = s.upstream.SetReadDeadline(time.Now().Add(u.config.IdleTimeout - s.idle()))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && s.idle() < u.config.IdleTimeout {
+				// the client sent datagrams in the meantime
+				continue
+			}
+			return
+		}
+		s.touch()
+		if _, err := s.conn.WriteTo(buf[:n], s.client); err != nil {
+			return
+		}
+	}
+}
+
+// end removes the session and releases its host
+func (u *UDPProxy) end(s *udpSession) {
+	u.mu.Lock()
+	if u.sessions[s.key] == s {
+		delete(u.sessions, s.key)
+	}
+	u.mu.Unlock()
+	s.upstream.Close()
+	u.lb.Done(s.host)
+}
+
+// Sessions returns the number of open sessions
+func (u *UDPProxy) Sessions() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.sessions)
+}
+
+// Shutdown closes the listeners and ends all the sessions
+func (u *UDPProxy) Shutdown() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for conn := range u.conns {
+		conn.Close()
+	}
+	for _, s := range u.sessions {
+		s.upstream.Close()
+	}
+}
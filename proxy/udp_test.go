@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoUDPServer answers each datagram with its name followed by the payload
+func echoUDPServer(t *testing.T, name string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(append([]byte(name), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+// exchange sends the payload and returns the reply, empty when none comes
+func exchange(t *testing.T, conn net.Conn, payload string) string {
+	_, err := conn.Write([]byte(payload))
+	assert.Nil(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestUDPProxy(t *testing.T) {
+	a, b := echoUDPServer(t, "a"), echoUDPServer(t, "b")
+	defer a.Close()
+	defer b.Close()
+
+	cases := []struct {
+		name        string
+		maxSessions int
+		replies     []string
+		sessions    int
+		dropped     int64
+	}{
+		{"sessions", 0, []string{"a", "b"}, 2, 0},
+		{"max_sessions", 1, []string{"a", ""}, 1, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			udpProxy, err := NewUDPProxy([]string{a.LocalAddr().String(), "udp://" + b.LocalAddr().String()}, "round-robin",
+				WithUDP(UDPConfig{IdleTimeout: 500 * time.Millisecond, MaxSessions: c.maxSessions}))
+			assert.Nil(t, err)
+			ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+			assert.Nil(t, err)
+			served := make(chan error, 1)
+			go func() { served <- udpProxy.Serve(ln) }()
+
+			// the datagrams of a client stick to the host of its session
+			for i, reply := range c.replies {
+				client, err := net.Dial("udp", ln.LocalAddr().String())
+				assert.Nil(t, err)
+				defer client.Close()
+				for _, payload := range []string{"ping", "pong"} {
+					expected := ""
+					if len(reply) != 0 {
+						expected = reply + payload
+					}
+					assert.Equal(t, expected, exchange(t, client, payload), "client %d", i)
+				}
+			}
+			assert.Equal(t, c.sessions, udpProxy.Sessions())
+			assert.Equal(t, c.dropped, udpProxy.Dropped())
+
+			// idle sessions end and release their host
+			assert.Eventually(t, func() bool { return udpProxy.Sessions() == 0 }, 2*time.Second, 20*time.Millisecond)
+
+			udpProxy.Shutdown()
+			assert.Equal(t, UDPProxyClosedError, <-served)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpgradeConfig refers to the handling of upgraded connections, such as WebSockets
+type UpgradeConfig struct {
+	// BalanceMode is the algorithm choosing the host of upgraded connections,
+	// empty uses the algorithm of the location
+	BalanceMode string
+	// IdleTimeout closes the tunnel after a period without traffic, 0 refers to no timeout
+	IdleTimeout time.Duration
+	// KeepAlive is the period of the tcp keep-alive probes to the client
+	KeepAlive time.Duration
+	// CloseOnRemove closes the tunnels to a host removed by the health check
+	// after DrainTimeout, unless the host is back by then
+	CloseOnRemove bool
+	DrainTimeout  time.Duration
+}
+
+// IsUpgrade reports whether the request asks for a protocol upgrade
+func IsUpgrade(r *http.Request) bool {
+	if len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnels tracks the upgraded connections of each host
+type tunnels struct {
+	sync.Mutex
+	conns map[string]map[*tunnelConn]struct{}
+}
+
+func (t *tunnels) add(c *tunnelConn) {
+	t.Lock()
+	defer t.Unlock()
+	if t.conns[c.host] == nil {
+		t.conns[c.host] = make(map[*tunnelConn]struct{})
+	}
+	t.conns[c.host][c] = struct{}{}
+}
+
+func (t *tunnels) remove(c *tunnelConn) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.conns[c.host], c)
+}
+
+// closeHost closes all the tunnels to the host
+func (t *tunnels) closeHost(host string) int {
+	t.Lock()
+	conns := make([]*tunnelConn, 0, len(t.conns[host]))
+	for c := range t.conns[host] {
+		conns = append(conns, c)
+	}
+	t.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// tunnelConn is the hijacked client connection of an upgraded request,
+// any traffic in either direction extends its idle deadline
+type tunnelConn struct {
+	net.Conn
+	host    string
+	idle    time.Duration
+	stats   *PoolStats
+	tunnels *tunnels
+	once    sync.Once
+}
+
+func (c *tunnelConn) extend() {
+	if c.idle > 0 {
+		_ = c.Conn.SetDeadline(time.Now().Add(c.idle))
+	}
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.Upgraded, -1)
+		c.tunnels.remove(c)
+	})
+	return c.Conn.Close()
+}
+
+// tcpConn returns the tcp connection under the tls and PROXY protocol layers
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// upgradeWriter registers the client connection as a tunnel to the host
+// when the reverse proxy hijacks it
+type upgradeWriter struct {
+	http.ResponseWriter
+	proxy *HTTPProxy
+	host  string
+}
+
+func (w *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := w.proxy.upgrade
+	// the timeouts of the server do not apply to long-lived tunnels
+	_ = conn.SetDeadline(time.Time{})
+	if cfg.KeepAlive > 0 {
+		if tcp, ok := tcpConn(conn); ok {
+			_ = tcp.SetKeepAlive(true)
+			_ = tcp.SetKeepAlivePeriod(cfg.KeepAlive)
+		} else {
+			log.Printf("keep-alive not supported by the upgraded connection of %s", conn.RemoteAddr())
+		}
+	}
+	tunnel := &tunnelConn{
+		Conn:    conn,
+		host:    w.host,
+		idle:    cfg.IdleTimeout,
+		stats:   w.proxy.poolStats[w.host],
+		tunnels: w.proxy.tunnels,
+	}
+	tunnel.extend()
+	atomic.AddInt64(&tunnel.stats.Upgraded, 1)
+	w.proxy.tunnels.add(tunnel)
+	return tunnel, rw, nil
+}
+
+func (w *upgradeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *upgradeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// drainTunnels closes the tunnels to a removed host after the drain timeout
+func (h *HTTPProxy) drainTunnels(host string) {
+	if !h.upgrade.CloseOnRemove {
+		return
+	}
+	time.AfterFunc(h.upgrade.DrainTimeout, func() {
+		if h.ReadAlive(host) {
+			return
+		}
+		if n := h.tunnels.closeHost(host); n > 0 {
+			log.Printf("Host is removed, close %d upgraded connections to %s.", n, host)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoUpgradeServer switches to the `echo` protocol and echoes the bytes
+func echoUpgradeServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+}
+
+// dialUpgrade opens an upgraded connection through the balancer
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return conn, r
+}
+
+func TestHTTPProxy_Upgrade(t *testing.T) {
+	backend := echoUpgradeServer()
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin",
+		WithUpgrade(UpgradeConfig{BalanceMode: "least-load", CloseOnRemove: true}))
+	assert.Nil(t, err)
+	balancer := httptest.NewServer(httpProxy)
+	defer balancer.Close()
+
+	conn, r := dialUpgrade(t, balancer.Listener.Addr().String())
+	defer conn.Close()
+	_, _ = conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(r, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(reply))
+	assert.Equal(t, int64(1), httpProxy.PoolStats()[u.Host].Upgraded)
+
+	// the health check removes the host, its tunnels are closed
+	httpProxy.SetAlive(u.Host, false)
+	httpProxy.drainTunnels(u.Host)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool {
+		return httpProxy.PoolStats()[u.Host].Upgraded == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHTTPProxy_UpgradeIdleTimeout(t *testing.T) {
+	backend := echoUpgradeServer()
+	defer backend.Close()
+
+	httpProxy, err := NewHTTPProxy([]string{backend.URL}, "round-robin",
+		WithUpgrade(UpgradeConfig{IdleTimeout: 100 * time.Millisecond}))
+	assert.Nil(t, err)
+	balancer := httptest.NewServer(httpProxy)
+	defer balancer.Close()
+
+	conn, r := dialUpgrade(t, balancer.Listener.Addr().String())
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cases := []struct {
+		name string
+		conn net.Conn
+		ok   bool
+	}{
+		{"tcp", conn, true},
+		{"tls", tls.Client(conn, &tls.Config{}), true},
+		{"proxy protocol", &proxyConn{Conn: conn}, true},
+		{"tls over proxy protocol", tls.Server(&proxyConn{Conn: conn}, &tls.Config{}), true},
+		{"pipe", client, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tcp, ok := tcpConn(c.conn)
+			assert.Equal(t, c.ok, ok)
+			if ok {
+				assert.Equal(t, conn, tcp)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"go-balancer/config"
+	"go-balancer/proxy"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// splitConfig returns the traffic split of the groups of the location
+func splitConfig(l *config.Location) proxy.SplitConfig {
+	split := proxy.SplitConfig{
+		Rules:   make([]proxy.SplitRule, 0, len(l.SplitRules)),
+		Weights: make(map[string]uint, len(l.Groups)),
+	}
+	for _, r := range l.SplitRules {
+		split.Rules = append(split.Rules, proxy.SplitRule{
+			Header: r.Header,
+			Cookie: r.Cookie,
+			Value:  r.Value,
+			Group:  r.Group,
+		})
+	}
+	for _, g := range l.Groups {
+		split.Weights[g.Name] = g.Weight
+	}
+	return split
+}
+
+// watchReload reloads the configuration file on SIGHUP
+func watchReload(fileName string, splits map[string]*proxy.SplitProxy) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reload(fileName, splits); err != nil {
+				log.Printf("reload config error: %s", err)
+			}
+		}
+	}()
+}
+
+// reload applies the weights and the split rules of the configuration file
+// to the running locations, the other settings require a restart. Nothing
+// is applied unless all the locations can be updated.
+func reload(fileName string, splits map[string]*proxy.SplitProxy) error {
+	c, err := config.ReadConfig(fileName)
+	if err != nil {
+		return err
+	}
+	if err := c.Validation(); err != nil {
+		return err
+	}
+
+	updates := make(map[string]proxy.SplitConfig)
+	for _, l := range c.Location {
+		split, ok := splits[l.Name]
+		if !ok {
+			continue
+		}
+		for _, g := range l.Groups {
+			if split.Group(g.Name) == nil {
+				return fmt.Errorf("the group %s of location %s is new, it requires a restart", g.Name, l.Name)
+			}
+		}
+		update := splitConfig(l)
+		if err := split.Validate(update); err != nil {
+			return fmt.Errorf("location %s: %w", l.Name, err)
+		}
+		updates[l.Name] = update
+	}
+	for name, update := range updates {
+		if err := splits[name].Update(update); err != nil {
+			return fmt.Errorf("location %s: %w", name, err)
+		}
+		log.Printf("Traffic split of location %s is updated: %v", name, update.Weights)
+	}
+	return nil
+}
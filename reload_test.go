@@ -0,0 +1,124 @@
+package main
+
+import (
+	"go-balancer/proxy"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reloadConfig is a configuration of the locations `a` and `b`, both split
+// between the groups stable and canary, followed by `groupsB`
+const reloadConfig = `
+schema: http
+port: 8080
+health_check_interval: 1
+location:
+  - pattern: /a
+    name: a
+    groups:
+      - name: stable
+        proxy_pass: ["http://127.0.0.1:1"]
+        weight: 50
+      - name: canary
+        proxy_pass: ["http://127.0.0.1:2"]
+        weight: 50
+  - pattern: /b
+    name: b
+    groups:
+`
+
+func newReloadSplits(t *testing.T) map[string]*proxy.SplitProxy {
+	splits := make(map[string]*proxy.SplitProxy)
+	for _, name := range []string{"a", "b"} {
+		groups := make(map[string]*proxy.HTTPProxy)
+		for _, group := range []string{"stable", "canary"} {
+			httpProxy, err := proxy.NewHTTPProxy([]string{"http://127.0.0.1:1"}, "round-robin")
+			assert.Nil(t, err)
+			groups[group] = httpProxy
+		}
+		split, err := proxy.NewSplitProxy(groups, []string{"stable", "canary"},
+			proxy.SplitConfig{Weights: map[string]uint{"stable": 100, "canary": 0}})
+		assert.Nil(t, err)
+		splits[name] = split
+	}
+	return splits
+}
+
+func TestReload(t *testing.T) {
+	cases := []struct {
+		name    string
+		groupsB string
+		err     bool
+		weights map[string]uint
+	}{
+		{"valid", `
+      - name: stable
+        proxy_pass: ["http://127.0.0.1:1"]
+        weight: 90
+      - name: canary
+        proxy_pass: ["http://127.0.0.1:2"]
+        weight: 10
+`, false, map[string]uint{"stable": 90, "canary": 10}},
+		{"new group", `
+      - name: stable
+        proxy_pass: ["http://127.0.0.1:1"]
+        weight: 90
+      - name: beta
+        proxy_pass: ["http://127.0.0.1:3"]
+        weight: 10
+`, true, nil},
+		{"invalid split rule", `
+      - name: stable
+        proxy_pass: ["http://127.0.0.1:1"]
+        weight: 90
+    split_rules:
+      - header: X-Beta
+        group: beta
+`, true, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "config.yaml")
+			assert.Nil(t, os.WriteFile(fileName, []byte(reloadConfig+c.groupsB), 0o644))
+			splits := newReloadSplits(t)
+
+			err := reload(fileName, splits)
+			if !c.err {
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]uint{"stable": 50, "canary": 50}, splits["a"].Weights())
+				assert.Equal(t, c.weights, splits["b"].Weights())
+				return
+			}
+			// an invalid location leaves every location unchanged
+			assert.NotNil(t, err)
+			for _, name := range []string{"a", "b"} {
+				assert.Equal(t, map[string]uint{"stable": 100, "canary": 0}, splits[name].Weights(), name)
+			}
+		})
+	}
+}
+
+func TestWatchReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(fileName, []byte(reloadConfig+`
+      - name: stable
+        proxy_pass: ["http://127.0.0.1:1"]
+        weight: 0
+      - name: canary
+        proxy_pass: ["http://127.0.0.1:2"]
+        weight: 1
+`), 0o644))
+	splits := newReloadSplits(t)
+	watchReload(fileName, splits)
+
+	// the weights are applied on SIGHUP
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		return splits["b"].Weights()["canary"] == 1 && splits["a"].Weights()["canary"] == 50
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-balancer/config"
+	"go-balancer/helpers"
+	"go-balancer/proxy"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ShutdownTimeout refers to the time given to in-flight requests when the balancer stops
+var ShutdownTimeout = 10 * time.Second
+
+// Server is a http server, or a tcp or udp proxy, bound to a listener of the configuration
+type Server struct {
+	listener *config.Listener
+	svr      *http.Server
+	tcp      *proxy.TCPProxy
+	udp      *proxy.UDPProxy
+}
+
+// NewTCPServer create new Server proxying the connections of the tcp listener
+func NewTCPServer(l *config.Listener, tcp *proxy.TCPProxy) *Server {
+	return &Server{
+		listener: l,
+		tcp:      tcp,
+	}
+}
+
+// NewServer create new Server for the listener with the timeouts of `c`
+func NewServer(c *config.Config, l *config.Listener, handler http.Handler) (*Server, error) {
+	if l.Redirect != nil && l.Redirect.Enabled {
+		handler = helpers.HTTPSRedirectMiddleware(l.Redirect.Port, l.Redirect.Status, l.Redirect.Exceptions)(handler)
+	}
+	if l.HSTS != nil && l.HSTS.Enabled {
+		handler = helpers.HSTSMiddleware(l.HSTS.MaxAge, l.HSTS.IncludeSubdomains, l.HSTS.Preload)(handler)
+	}
+	// the locations are served by several listeners, a client subject header
+	// sent to any of them is only set from a verified certificate
+	for _, header := range clientSubjectHeaders(c) {
+		handler = helpers.ClientCertMiddleware(header)(handler)
+	}
+	svr := &http.Server{
+		Addr:              l.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(c.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(c.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(c.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+	if l.H2C {
+		svr.Protocols = &http.Protocols{}
+		svr.Protocols.SetHTTP1(true)
+		svr.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if l.Schema == "https" {
+		tlsConfig, err := newTLSConfig(l)
+		if err != nil {
+			return nil, err
+		}
+		svr.TLSConfig = tlsConfig
+		// http/2 is negotiated by ALPN, leave it out unless it is listed
+		if len(tlsConfig.NextProtos) != 0 && !contains(tlsConfig.NextProtos, "h2") {
+			svr.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+	return &Server{
+		listener: l,
+		svr:      svr,
+	}, nil
+}
+
+// clientSubjectHeaders returns the client subject headers of all the listeners
+func clientSubjectHeaders(c *config.Config) []string {
+	headers := make([]string, 0)
+	for _, l := range c.Listeners {
+		if l.TLS != nil && len(l.TLS.ClientSubjectHeader) != 0 && !contains(headers, l.TLS.ClientSubjectHeader) {
+			headers = append(headers, l.TLS.ClientSubjectHeader)
+		}
+	}
+	return headers
+}
+
+// newTLSConfig builds the certificates and the tls policy of the listener
+func newTLSConfig(l *config.Listener) (*tls.Config, error) {
+	pairs := make([]helpers.CertPair, 0)
+	for _, c := range l.CertificatePairs() {
+		pairs = append(pairs, helpers.CertPair{CertFile: c.Certificate, KeyFile: c.Key})
+	}
+	store, err := helpers.NewCertStore(pairs)
+	if err != nil {
+		return nil, err
+	}
+	if l.CertificateReloadInterval > 0 {
+		store.Watch(l.CertificateReloadInterval)
+	}
+	tlsConfig := &tls.Config{GetCertificate: store.GetCertificate}
+
+	policy := l.TLS
+	if policy == nil {
+		return tlsConfig, nil
+	}
+	if tlsConfig.MinVersion, err = helpers.ParseTLSVersion(policy.MinVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.MaxVersion, err = helpers.ParseTLSVersion(policy.MaxVersion); err != nil {
+		return nil, err
+	}
+	if len(policy.CipherSuites) != 0 {
+		if tlsConfig.CipherSuites, err = helpers.ParseCipherSuites(policy.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	if len(policy.CurvePreferences) != 0 {
+		if tlsConfig.CurvePreferences, err = helpers.ParseCurves(policy.CurvePreferences); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig.NextProtos = policy.ALPN
+	if tlsConfig.ClientAuth, err = helpers.ParseClientAuth(policy.ClientAuth); err != nil {
+		return nil, err
+	}
+	if len(policy.ClientCA) != 0 {
+		if tlsConfig.ClientCAs, err = helpers.LoadCertPool(policy.ClientCA); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUDPServer create new Server proxying the datagrams of the udp listener
+func NewUDPServer(l *config.Listener, udp *proxy.UDPProxy) *Server {
+	return &Server{
+		listener: l,
+		udp:      udp,
+	}
+}
+
+// ListenAndServe listens on the address of the listener and serves until
+// the server is shut down
+func (s *Server) ListenAndServe() error {
+	if s.udp != nil {
+		conn, err := net.ListenPacket("udp", s.listener.Address)
+		if err != nil {
+			return err
+		}
+		return s.udp.Serve(conn)
+	}
+	ln, err := net.Listen("tcp", s.listener.Address)
+	if err != nil {
+		return err
+	}
+	if s.listener.AcceptProxyProtocol {
+		ln = proxy.NewProxyProtocolListener(ln)
+	}
+	if s.tcp != nil {
+		return s.tcp.Serve(ln)
+	}
+	if s.listener.Schema == "https" {
+		return s.svr.ServeTLS(ln, "", "")
+	}
+	return s.svr.Serve(ln)
+}
+
+// Serve starts all the servers, when one of them fails or the process is
+// interrupted, all of them are shut down together
+func Serve(servers []*Server) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *Server) {
+			err := s.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, proxy.TCPProxyClosedError) &&
+				!errors.Is(err, proxy.UDPProxyClosedError) {
+				errs <- fmt.Errorf("listener %s: %w", s.listener.Name, err)
+			}
+		}(s)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down.", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if e := s.Shutdown(ctx); e != nil {
+			log.Printf("shutdown listener %s error: %s", s.listener.Name, e)
+		}
+	}
+	return err
+}
+
+// Shutdown stops the listener and waits for the in-flight requests, or the
+// open connections of a tcp listener, until the context is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.udp != nil {
+		s.udp.Shutdown()
+		return nil
+	}
+	if s.tcp != nil {
+		return s.tcp.Shutdown(ctx)
+	}
+	return s.svr.Shutdown(ctx)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"go-balancer/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// freeAddress returns a local address nothing listens on
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func newTestServer(t *testing.T, name, address string) *Server {
+	s, err := NewServer(&config.Config{}, &config.Listener{Name: name, Address: address, Schema: "http"},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	assert.Nil(t, err)
+	return s
+}
+
+func listening(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestServe(t *testing.T) {
+	// the signals of the test are not delivered to the default handler
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer busy.Close()
+
+	cases := []struct {
+		name   string
+		failed bool
+	}{
+		{"listener failure", true},
+		{"signal", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			first := newTestServer(t, "first", freeAddress(t))
+			second := newTestServer(t, "second", freeAddress(t))
+			if c.failed {
+				// the address of the second listener is in use
+				second = newTestServer(t, "second", busy.Addr().String())
+			}
+
+			served := make(chan error, 1)
+			go func() { served <- Serve([]*Server{first, second}) }()
+			if !c.failed {
+				assert.Eventually(t, func() bool {
+					return listening(first.listener.Address) && listening(second.listener.Address)
+				}, time.Second, 10*time.Millisecond)
+				assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+			}
+
+			select {
+			case err := <-served:
+				if c.failed {
+					assert.ErrorContains(t, err, "listener second")
+				} else {
+					assert.Nil(t, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the servers are still running")
+			}
+			// every server is shut down, none of them serves again
+			for _, s := range []*Server{first, second} {
+				if s.listener.Address != busy.Addr().String() {
+					assert.Eventually(t, func() bool { return !listening(s.listener.Address) }, time.Second, 10*time.Millisecond)
+				}
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				assert.Nil(t, err)
+				assert.ErrorIs(t, s.svr.Serve(ln), http.ErrServerClosed)
+			}
+		})
+	}
+}
+
+func TestNewServer_ClientSubjectHeader(t *testing.T) {
+	mtls := &config.Listener{Name: "mtls", Address: ":443", Schema: "https",
+		TLS: &config.TLS{ClientAuth: "require", ClientSubjectHeader: "X-Client-Subject"}}
+	plain := &config.Listener{Name: "plain", Address: ":80", Schema: "http"}
+	c := &config.Config{Listeners: []*config.Listener{mtls, plain}}
+
+	var subject string
+	s, err := NewServer(c, plain, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = r.Header.Get("X-Client-Subject")
+	}))
+	assert.Nil(t, err)
+
+	// a plain http client cannot forge the identity of a mTLS client
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Client-Subject", "CN=admin")
+	s.svr.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "", subject)
+}